@@ -6,12 +6,21 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// apiHeaderTimeout bounds reading the request headers
+	apiHeaderTimeout = 10 * time.Second
+	// apiTimeoutMargin leaves time past the route deadline to read the body and write the response
+	apiTimeoutMargin = 5 * time.Second
 )
 
 type NuesApi struct {
@@ -23,7 +32,7 @@ func Ping(context.Context, map[string]any) RouteResponse {
 	return RouteResponse{"response": true}
 }
 
-func (h *NuesApi) httpServe(route Route, r *http.Request) (any, error) {
+func (h *NuesApi) httpServe(ctx context.Context, route Route, r *http.Request) (any, error) {
 
 	body, err := io.ReadAll(r.Body)
 
@@ -45,7 +54,7 @@ func (h *NuesApi) httpServe(route Route, r *http.Request) (any, error) {
 			}
 		}
 
-		res := handler(h.context, reqBody)
+		res := handler(ctx, reqBody)
 		return res, nil
 
 	case COMMAND:
@@ -65,7 +74,7 @@ func (h *NuesApi) httpServe(route Route, r *http.Request) (any, error) {
 			Command: cmd,
 			CallId:  callId,
 		}
-		cmdRoot.Execute(h.context)
+		cmdRoot.Execute(ctx)
 		return cmdRoot, nil
 
 	case QUERY:
@@ -80,21 +89,50 @@ func (h *NuesApi) httpServe(route Route, r *http.Request) (any, error) {
 				return nil, ErrBadCommand
 			}
 		}
+		minSeq, err := requestMinSequence(r)
+		if err != nil {
+			return nil, ErrBadCommand
+		}
+		if minSeq > 0 {
+			ctx = WithMinSequence(ctx, minSeq)
+		}
 		queryRoot := &QueryRoot{
 			Query: query,
 		}
-		queryRoot.Execute(h.context)
+		queryRoot.Execute(ctx)
 		return queryRoot, nil
 	}
 	return nil, ErrSystemInternal
 
 }
 
+// requestMinSequence reads the sequence a query must see from the header or the min_sequence URL parameter
+func requestMinSequence(r *http.Request) (int64, error) {
+	value := r.Header.Get(HeaderMinSequence)
+	if value == "" {
+		value = r.URL.Query().Get("min_sequence")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// responseStatus maps idempotency conflicts to 409, every other outcome is carried in the body
+func responseStatus(response any) int {
+	if cr, ok := response.(*CommandRoot); ok && (cr.Error == ErrCallConflict || cr.Error == ErrCallInProgress) {
+		return http.StatusConflict
+	}
+	return http.StatusOK
+}
+
 func (h *NuesApi) config() {
 
 	slog.Info("Runing API server configuration")
+	http.HandleFunc("/subscribe/", h.subscribe)
 	http.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
 
+		start := time.Now()
 		fullpath := r.URL.Path
 		slog.Debug("API call", "path", fullpath)
 		var parts []string
@@ -105,9 +143,11 @@ func (h *NuesApi) config() {
 		var response any
 		var err error
 		var callId string
-		var called bool
 		var token string
 		var cookie *http.Cookie
+		var ctx context.Context
+		var cancel context.CancelFunc
+		var span trace.Span
 
 		if r.Method != http.MethodPost {
 			goto abort
@@ -129,7 +169,15 @@ func (h *NuesApi) config() {
 		if !found {
 			goto abort
 		}
-		slog.Info("serving route", "path", path, "route", route)
+		callId = r.Header.Get("callId")
+		ctx, cancel = context.WithTimeout(propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header)), route.timeout())
+		defer cancel()
+		ctx, span = startSpan(ctx, "api "+route.Name, trace.SpanKindServer, attribute.String("nues.route", route.Name))
+		defer func() {
+			endSpan(span, err)
+		}()
+		ctx = WithLogAttrs(ctx, slog.String("route", route.Name), slog.String("call_id", callId))
+		slog.InfoContext(ctx, "serving route", "path", path)
 		cookie, _ = r.Cookie("token")
 		if cookie != nil {
 			token = cookie.Value
@@ -137,32 +185,19 @@ func (h *NuesApi) config() {
 		if token == "" {
 			token = r.Header.Get("token")
 		}
-		auth = authCall(token, route)
+		auth = authCall(ctx, token, route)
 		if !auth {
 			goto notAuthed
 		}
-
-		callId = r.Header.Get("callId")
-
-		if callId != "" {
-			// try call history
-			var call bson.M
-			err := DB.GetCollection(nues.colCommands).FindOne(context.TODO(), bson.M{"_id": callId}).Decode(&call)
-			if err != nil && err != mongo.ErrNoDocuments {
-				goto abort
-			}
-			if call != nil {
-				//Idempotency detected
-				called = true
-				response = call["response"]
-			}
-		}
-		if !called {
-			response, err = h.httpServe(route, r)
+		if !route.Public {
+			ctx = WithLogAttrs(ctx, slog.String("identity", tokenIdentity(token)))
 		}
 
+		response, err = h.httpServe(ctx, route, r)
+		observeCall("api", route, start, response, err)
+
 		if err != nil {
-			slog.Error("http failed", "err", err)
+			slog.ErrorContext(ctx, "http failed", "err", err)
 			goto errored
 		} else {
 			var responseB []byte
@@ -171,14 +206,19 @@ func (h *NuesApi) config() {
 				goto abort
 			}
 			w.Header().Add("content-type", "application/json; charset=utf-8")
+			if cr, ok := response.(*CommandRoot); ok && cr.Sequence > 0 {
+				w.Header().Set(HeaderSequence, strconv.FormatInt(cr.Sequence, 10))
+			}
+			w.WriteHeader(responseStatus(response))
 			_, err = w.Write(responseB)
 			if err != nil {
-				slog.Error("http response error", "err", err)
+				slog.ErrorContext(ctx, "http response error", "err", err)
 			}
 		}
 		return
 
 	notAuthed:
+		observeCall("api", route, start, nil, ErrUserNotAuth)
 		http.Error(w, "not logged in", http.StatusUnauthorized)
 		return
 	errored:
@@ -191,6 +231,15 @@ func (h *NuesApi) config() {
 	})
 }
 
+// apiServerTimeout outlasts the longest route timeout, the route deadline is what bounds a call
+func apiServerTimeout() time.Duration {
+	timeout := defaultRequestTimeout
+	for _, route := range nues.Routes {
+		timeout = max(timeout, route.timeout())
+	}
+	return timeout + apiTimeoutMargin
+}
+
 func (h *NuesApi) Close() error {
 
 	return h.server.Close()
@@ -201,9 +250,11 @@ func (h *NuesApi) Serve(ctx context.Context) {
 	h.config()
 
 	h.server = &http.Server{
-		Addr:           nues.ApiPort,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+		Addr:              nues.ApiPort,
+		ReadHeaderTimeout: apiHeaderTimeout,
+		// past the read timeout the request context is cancelled, both outlast the route deadlines
+		ReadTimeout:    apiServerTimeout(),
+		WriteTimeout:   apiServerTimeout(),
 		MaxHeaderBytes: 1 << 20,
 	}
 
@@ -0,0 +1,22 @@
+package nues
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApiServerTimeoutOutlastsRoutes(t *testing.T) {
+	nues.Routes = Routes{
+		"quick": {Name: "quick"},
+		"slow":  {Name: "slow", Timeout: time.Minute},
+	}
+	t.Cleanup(func() { nues.Routes = nil })
+
+	if got := apiServerTimeout(); got != time.Minute+apiTimeoutMargin {
+		t.Fatalf("apiServerTimeout() = %v", got)
+	}
+	nues.Routes = Routes{"quick": {Name: "quick"}}
+	if got := apiServerTimeout(); got != defaultRequestTimeout+apiTimeoutMargin {
+		t.Fatalf("apiServerTimeout() = %v", got)
+	}
+}
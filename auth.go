@@ -22,31 +22,34 @@ type Session struct {
 	Token      string `validate:"required" json:"token"`
 }
 
-func initAuth() {
+func initAuth(ctx context.Context) {
 
-	// register service as identity
-	identity := Identity{
-		Name:            nues.ServiceId,
-		IdentityId:      nues.ServiceId,
-		AllowedServices: map[string][]string{},
+	// register service as identity, the access it was given is kept
+	_, err := DB.GetCollection(nues.colIdentity).UpdateOne(ctx, bson.M{"_id": nues.ServiceId},
+		bson.M{"$set": bson.M{"name": nues.ServiceId}, "$setOnInsert": bson.M{"allowedservices": map[string][]string{}}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		panic(err)
 	}
-	err := RegisterNewIdentity(identity)
+	// the service calls other services with its own session, their AllowedServices rules apply to it
+	session, err := RegisterNewSession(ctx, nues.ServiceId)
 	if err != nil {
 		panic(err)
 	}
+	nues.serviceToken = session.Token
 }
 
-func ClearSessions(identityId string) error {
-	_, err := DB.GetCollection(nues.colSessions).DeleteMany(context.TODO(), bson.M{"_id": identityId})
+func ClearSessions(ctx context.Context, identityId string) error {
+	_, err := DB.GetCollection(nues.colSessions).DeleteMany(ctx, bson.M{"_id": identityId})
 	return err
 
 }
-func RegisterNewSession(identityId string) (*Session, error) {
+func RegisterNewSession(ctx context.Context, identityId string) (*Session, error) {
 	if identityId == "" {
 		return nil, NewError(-1, "identity id is required")
 	}
 	var identity Identity
-	err := DB.GetCollection(nues.colIdentity).FindOne(context.TODO(), bson.M{"_id": identityId}).Decode(&identity)
+	err := DB.GetCollection(nues.colIdentity).FindOne(ctx, bson.M{"_id": identityId}).Decode(&identity)
 	if err != nil {
 
 		return nil, err
@@ -58,14 +61,14 @@ func RegisterNewSession(identityId string) (*Session, error) {
 		IdentityId: identityId,
 		Token:      fmt.Sprintf("%s:%s", identityId, GenerateId()),
 	}
-	err = validate.Struct(session)
+	err = validate.StructCtx(ctx, session)
 	if err != nil {
 		return nil, err
 	}
-	_, err = DB.GetCollection(nues.colSessions).InsertOne(context.TODO(), session)
+	_, err = DB.GetCollection(nues.colSessions).InsertOne(ctx, session)
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
-			err = DB.GetCollection(nues.colSessions).FindOne(context.TODO(), bson.M{"_id": identityId}).Decode(session)
+			err = DB.GetCollection(nues.colSessions).FindOne(ctx, bson.M{"_id": identityId}).Decode(session)
 			if err != nil {
 				return nil, ErrSystemInternal
 			}
@@ -76,7 +79,7 @@ func RegisterNewSession(identityId string) (*Session, error) {
 	return session, err
 }
 
-func RegisterNewIdentity(identity Identity) error {
+func RegisterNewIdentity(ctx context.Context, identity Identity) error {
 
 	if err := AssertNotEmpty(identity.IdentityId, NewError(-1, "identity id is required")); err != nil {
 		return err
@@ -86,7 +89,7 @@ func RegisterNewIdentity(identity Identity) error {
 		return err
 	}
 
-	_, err := DB.GetCollection(nues.colIdentity).UpdateOne(context.TODO(), bson.M{"_id": identity.IdentityId}, bson.M{"$set": identity}, options.Update().SetUpsert(true))
+	_, err := DB.GetCollection(nues.colIdentity).UpdateOne(ctx, bson.M{"_id": identity.IdentityId}, bson.M{"$set": identity}, options.Update().SetUpsert(true))
 
 	if err != nil {
 		return err
@@ -94,11 +97,26 @@ func RegisterNewIdentity(identity Identity) error {
 	return nil
 }
 
-func authCall(headerToken string, route Route) bool {
+// tokenIdentity returns the identity a token claims, it does not validate the token
+func tokenIdentity(headerToken string) string {
+	if headerToken == "" {
+		return ""
+	}
+	if nues.adminToken == headerToken {
+		return nues.ServiceId
+	}
+	identityId, _, _ := strings.Cut(headerToken, ":")
+	return identityId
+}
+
+func authCall(ctx context.Context, headerToken string, route Route) bool {
 
 	if route.Name == "" {
 		panic("route name is required")
 	}
+	if route.Admin {
+		return headerToken != "" && headerToken == nues.adminToken
+	}
 	if route.Public {
 		return true
 	}
@@ -110,28 +128,31 @@ func authCall(headerToken string, route Route) bool {
 		return true
 	}
 
-	parts := strings.Split(headerToken, ":")
-	if len(parts) != 2 {
+	// tokens are issued as identityId:secret, see RegisterNewSession
+	identityId, _, found := strings.Cut(headerToken, ":")
+	if !found || identityId == "" {
 		return false
 	}
-	identityId := parts[0]
-	token := parts[1]
 
-	var session *Session
-	err := DB.GetCollection(nues.colSessions).FindOne(context.TODO(), bson.M{"token": token, "_id": identityId}).Decode(session)
-	if err != nil || session == nil {
+	var session Session
+	err := DB.GetCollection(nues.colSessions).FindOne(ctx, bson.M{"token": headerToken, "_id": identityId}).Decode(&session)
+	if err != nil {
 		return false
 	}
-	var identity *Identity
-	err = DB.GetCollection(nues.colIdentity).FindOne(context.TODO(), bson.M{"_id": session.IdentityId}).Decode(identity)
-	if err != nil || identity == nil {
+	var identity Identity
+	err = DB.GetCollection(nues.colIdentity).FindOne(ctx, bson.M{"_id": session.IdentityId}).Decode(&identity)
+	if err != nil {
 		return false
 	}
 
 	if len(identity.AllowedServices) == 0 {
 		return true
 	}
+	// access is granted to this instance or to every instance of the service
 	access, found := identity.AllowedServices[nues.ServiceId]
+	if !found {
+		access, found = identity.AllowedServices[nues.ServiceName]
+	}
 	if !found {
 		return false
 	}
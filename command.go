@@ -4,18 +4,21 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"reflect"
 	"time"
 
 	"github.com/go-playground/validator/v10"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type CommandResponse any
 
 var validate = validator.New(validator.WithRequiredStructEnabled())
 
+// commandCommitAttempts is how many times a commit with an unknown result is sent again
+const commandCommitAttempts = 5
+
 type Command interface {
 	Handle(context.Context) (CommandResponse, error)
 }
@@ -27,10 +30,15 @@ type CommandRoot struct {
 	Command  Command         `json:"command"`
 	Ts       string          `json:"ts"`
 	CallId   string          `json:"callId"`
+	// Replayed is set when the result comes from an earlier call with the same CallId
+	Replayed bool `json:"replayed"`
+	// Sequence is the one of the last event the command registered, reads passing it see the command,
+	// see WithMinSequence
+	Sequence int64 `json:"sequence,omitempty"`
 }
 
-func (cr *CommandRoot) validate() SysError {
-	err := validate.Struct(cr.Command)
+func (cr *CommandRoot) validate(ctx context.Context) SysError {
+	err := validate.StructCtx(ctx, cr.Command)
 	if err != nil {
 		var errMsg string
 		for _, err := range err.(validator.ValidationErrors) {
@@ -46,34 +54,89 @@ func (cr *CommandRoot) validate() SysError {
 func (cr *CommandRoot) Execute(ctx context.Context) {
 
 	start := time.Now()
+	cmdName := typeName(cr.Command)
+	ctx, span := startSpan(ctx, "command "+cmdName, trace.SpanKindInternal, attribute.String("nues.call_id", cr.CallId))
 	defer func() {
 		cr.Ts = time.Since(start).String()
+		endSpan(span, cr.Error)
 	}()
 
-	err := cr.validate()
+	if cr.CallId != "" {
+		hash, err := fingerprint(cmdName, cr.Command)
+		if err != nil {
+			cr.Error = ErrBadCommand
+			return
+		}
+		result, sysErr := reserveCall(ctx, cr.CallId, hash)
+		if sysErr != nil {
+			cr.Error = sysErr
+			return
+		}
+		if result != nil {
+			metricIdempotencyHits.WithLabelValues(cmdName).Inc()
+			cr.Response, cr.Executed, cr.Error, cr.Sequence = result.Response, result.Executed, result.Error, result.Sequence
+			cr.Replayed = true
+			return
+		}
+		defer func() {
+			// keep deterministic failures, otherwise free the callId for a retry
+			if !cr.Executed && cr.Error != nil && isFinalError(ctx, cr.Error) {
+				if err := completeCall(context.WithoutCancel(ctx), cr.CallId, callResult{Error: cr.Error}); err == nil {
+					return
+				}
+			}
+			if !cr.Executed {
+				releaseCall(context.WithoutCancel(ctx), cr.CallId)
+			}
+		}()
+	}
+
+	err := cr.validate(ctx)
 	if err != nil {
 		cr.Error = err
 		return
 	}
+	// a conflict is retried until the request deadline, they only happen while a command commits
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultRequestTimeout)
+	}
+	for attempt := 1; cr.transact(ctx, cmdName); attempt++ {
+		if time.Now().After(deadline) || !sleepBackoff(ctx, attempt-1) {
+			slog.ErrorContext(ctx, "command transaction conflicts", "cmd", cmdName, "attempts", attempt)
+			cr.Error = ErrSystemInternal
+			return
+		}
+		slog.WarnContext(ctx, "command transaction conflict, retrying", "cmd", cmdName, "attempt", attempt)
+	}
+}
+
+// transact runs the command in a transaction, it returns true when the transaction lost the event
+// sequence counter to a concurrent one while committing and has to run again
+func (cr *CommandRoot) transact(ctx context.Context, cmdName string) bool {
+	cr.Response, cr.Error, cr.Executed = nil, nil, false
 	session, err := DB.Client().StartSession()
 
 	if err != nil {
-		slog.Error("command session creation error", err)
+		slog.ErrorContext(ctx, "command session creation error", "err", err)
 		cr.Error = ErrSystemInternal
-		return
+		return false
 	}
 	if err = session.StartTransaction(); err != nil {
-		slog.Error("command session creation error", err)
+		slog.ErrorContext(ctx, "command session creation error", "err", err)
 		cr.Error = ErrSystemInternal
-		return
+		return false
 	}
 
-	defer session.EndSession(context.TODO())
+	// abort and attempt bookkeeping must run even when the request context is done
+	cleanupCtx := context.WithoutCancel(ctx)
+	defer session.EndSession(cleanupCtx)
+	ctx, tracker := withSequenceTracker(ctx)
 	ctxMongo := mongo.NewSessionContext(ctx, session)
 	cr.Response, cr.Error = cr.Command.Handle(ctxMongo)
 	if cr.Error == nil {
 		// validate response
-		err = validate.Struct(cr.Response)
+		err = validate.StructCtx(ctx, cr.Response)
 		if err != nil {
 			var errMsg string
 			for _, err := range err.(validator.ValidationErrors) {
@@ -82,43 +145,63 @@ func (cr *CommandRoot) Execute(ctx context.Context) {
 			cr.Error = NewError(-1, errMsg)
 		}
 	}
+	if cr.Error == nil {
+		err := tracker.flush(ctxMongo)
+		if hasErrorLabel(err, "TransientTransactionError") {
+			if err := session.AbortTransaction(cleanupCtx); err != nil {
+				slog.ErrorContext(ctx, "can't abort transaction", "err", err)
+			}
+			return true
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "event save failed", "err", err)
+			cr.Error = ErrSystemInternal
+		}
+	}
 	if cr.Error != nil {
-		slog.Error("command error", cr.Error)
-		evName := reflect.TypeOf(cr.Command).Elem()
-		slog.Debug("fail attempt", "CMD", evName)
+		slog.ErrorContext(ctx, "command error", "cmd", cmdName, "err", cr.Error)
+		metricCommandAborts.WithLabelValues(cmdName).Inc()
+		// aborted first, the transaction may hold the sequence counter the attempt event needs
+		if err := session.AbortTransaction(cleanupCtx); err != nil {
+			slog.ErrorContext(ctx, "can't abort transaction", "err", err)
+			cr.Error = ErrSystemInternal
+			return false
+		}
 		evAttempt := EvAttempt{
 			Command: cr,
-			EvName:  evName.Name(),
-		}
-		if err := RegisterEvents(nil, evAttempt); err != nil {
-			slog.Error("attempt event register failed", err)
-			cr.Error = ErrSystemInternal
-			return
+			EvName:  cmdName,
 		}
-
-		if err := session.AbortTransaction(context.TODO()); err != nil {
-			slog.Error("can't abort transaction", err)
+		if err := RegisterEvents(cleanupCtx, evAttempt); err != nil {
+			slog.ErrorContext(ctx, "attempt event register failed", "err", err)
 			cr.Error = ErrSystemInternal
-			return
+			return false
 		}
 	} else {
 		cr.Executed = true
 		if cr.CallId != "" {
-			// save command result for Idempotent check
-			_, err := DB.GetCollection(nues.colCommands).InsertOne(context.TODO(), bson.M{"_id": cr.CallId, "response": cr, "date": time.Now()})
+			// save command result for Idempotent check, it commits with the transaction
+			err := completeCall(ctxMongo, cr.CallId, callResult{Response: cr.Response, Executed: true, Sequence: tracker.last.Load()})
 			if err != nil {
+				slog.ErrorContext(ctx, "saving call result failed", "err", err)
 				cr.Error = ErrSystemInternal
 				cr.Executed = false
-				return
+				return false
 			}
 		}
-		if err := session.CommitTransaction(context.TODO()); err != nil {
-			slog.Error("error commiting transaction", err)
+		err := session.CommitTransaction(ctx)
+		for i := 0; err != nil && hasErrorLabel(err, "UnknownTransactionCommitResult") && i < commandCommitAttempts; i++ {
+			err = session.CommitTransaction(ctx)
+		}
+		if err != nil && hasErrorLabel(err, "TransientTransactionError") {
+			return true
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "error commiting transaction", "err", err)
 			cr.Error = ErrSystemInternal
 			cr.Executed = false
-			return
+			return false
 		}
-
+		cr.Sequence = tracker.last.Load()
 	}
-
+	return false
 }
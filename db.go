@@ -5,13 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"sync"
-	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 type Database struct {
@@ -21,107 +18,10 @@ type Database struct {
 
 var DB *Database
 
-var watchMutex sync.Mutex = sync.Mutex{}
-
 func (d *Database) Events() *mongo.Collection {
 	return d.GetCollection(nues.colEvents)
 }
 
-func (d *Database) WatchEvents(eventName string, callback func(Event) error) error {
-
-	var changeEvent struct {
-		ResumeAfter   bson.M `bson:"_id"`
-		OperationType string `bson:"operationType"`
-		FullDocument  bson.M `bson:"fullDocument"`
-	}
-
-	pipe := bson.D{{"$match", bson.D{{"operationType", "insert"}, {"fullDocument.name", eventName}}}}
-
-	var resumeAfter bson.M
-	err := d.GetCollection(nues.colWatchers).FindOne(context.TODO(), bson.M{"_id": eventName}).Decode(&resumeAfter)
-	if err != nil {
-		if err != mongo.ErrNoDocuments {
-			slog.Error("watcher failed for event", "event", eventName, "error", err)
-			return err
-		}
-		resumeAfter = bson.M{"_id": eventName, "resume": nil}
-		_, err := d.GetCollection(nues.colWatchers).InsertOne(context.TODO(), resumeAfter)
-		if err != nil {
-			slog.Error("watcher failed to insert watcher doc", "event", eventName, "error", err)
-			return err
-		}
-	}
-	st, err := d.GetCollection(nues.colEvents).Watch(context.TODO(), mongo.Pipeline{
-		pipe,
-	}, options.ChangeStream().SetFullDocument(options.UpdateLookup).SetResumeAfter(resumeAfter["resume"]))
-
-	if err != nil {
-		return err
-	}
-
-	// get last watch date
-
-	go func() {
-		defer st.Close(context.TODO())
-
-		for {
-			err := d.Client().Ping(context.Background(), readpref.Primary())
-			if err != nil {
-				time.Sleep(time.Second)
-				continue
-			}
-			break
-
-		}
-
-		for {
-			available := st.Next(context.TODO())
-			if available {
-
-				if err := st.Decode(&changeEvent); err != nil {
-					slog.Error("watch decode failed", err)
-					panic(err)
-				}
-
-				var ev Event
-				pl, err := bson.Marshal(changeEvent.FullDocument)
-				if err != nil {
-					slog.Error("watch decode failed", err)
-
-					continue
-				}
-				bson.Unmarshal(pl, &ev)
-				slog.Debug("event", "op", ev.Name)
-				watchMutex.Lock()
-				err = callback(ev)
-				if err != nil {
-					slog.Error("watcher callback failed", "ev", eventName, "seq", ev, "err", err)
-				} else {
-					DB.GetCollection(nues.colWatchers).UpdateOne(context.TODO(), bson.M{"_id": eventName},
-						bson.D{
-							{"$set", bson.M{"resume": changeEvent.ResumeAfter, "changed": time.Now()}}},
-					)
-				}
-				watchMutex.Unlock()
-			} else {
-				if err := st.Err(); err != nil {
-					if errors.Is(err, mongo.ErrClientDisconnected) {
-						slog.Info("watcher stopping...", "eventName", eventName)
-						return
-					}
-
-					slog.Error("watcher db error", err)
-					panic(err)
-
-				}
-			}
-		}
-	}()
-
-	return nil
-
-}
-
 // func getInternalDb() *Database {
 // 	configDb := "sabil"
 // 	db, err := InitNewDb(nues.DbUri, configDb, false)
@@ -131,61 +31,76 @@ func (d *Database) WatchEvents(eventName string, callback func(Event) error) err
 // 	return db
 // }
 
-func GetConfig[T ConfigService](doPanic bool) *T {
+func GetConfig[T ConfigService](ctx context.Context, doPanic bool) *T {
 
-	var config *T
-	err := DB.Collection("__config").FindOne(context.TODO(), bson.M{"_id": (*config).Name()}).Decode(config)
+	var config T
+	err := DB.Collection("__config").FindOne(ctx, bson.M{"_id": config.Name()}).Decode(&config)
 	if err != nil {
 		if doPanic {
 			panic(err)
 		}
 		return nil
 	}
-	return config
+	return &config
 }
 
+// GetCollection returns the prefixed collection col, a projection name resolves to the collection
+// serving it
 func (d *Database) GetCollection(col string) *mongo.Collection {
 	if col == "" {
 		panic("no collection should be empty, something is seriously wrong")
 	}
+	return d.physicalCollection(projectionCollectionName(col))
+}
+
+// ProjectionCollection returns the collection the projection name is written to with ctx, the shadow
+// one when ctx comes from its rebuild and the one serving it otherwise
+func (d *Database) ProjectionCollection(ctx context.Context, name string) *mongo.Collection {
+	if name == "" {
+		panic("no collection should be empty, something is seriously wrong")
+	}
+	return d.physicalCollection(projectionWriterName(ctx, name))
+}
+
+func (d *Database) physicalCollection(col string) *mongo.Collection {
 	return d.Collection(fmt.Sprintf("%s_%s", nues.dbPrefix, col))
 }
 
-func (d *Database) GetOne(Collection, field, value string) (*bson.M, error) {
+func (d *Database) GetOne(ctx context.Context, Collection, field, value string) (*bson.M, error) {
 	doc := &bson.M{}
-	err := d.GetCollection(Collection).FindOne(context.TODO(), bson.D{{field, value}}).Decode(doc)
+	err := d.GetCollection(Collection).FindOne(ctx, bson.D{{field, value}}).Decode(doc)
 	return doc, err
 }
 
-func (d *Database) Upsert(Collection, field, value string, doc interface{}) error {
+func (d *Database) Upsert(ctx context.Context, Collection, field, value string, doc interface{}) error {
 	if value == "" {
-		slog.Info("DB Upsert value is empty %s: field %s ", Collection, field)
+		slog.InfoContext(ctx, "DB Upsert value is empty", "collection", Collection, "field", field)
 		return ErrSystemInternal
 	}
-	res, err := d.GetCollection(Collection).ReplaceOne(context.TODO(), bson.D{{field, value}}, doc, options.Replace().SetUpsert(true))
+	res, err := d.GetCollection(Collection).ReplaceOne(ctx, bson.D{{field, value}}, doc, options.Replace().SetUpsert(true))
 	if err != nil {
-		slog.Error("upsert failed", err)
+		slog.ErrorContext(ctx, "upsert failed", "err", err)
 		return err
 	}
 	if res.ModifiedCount+res.UpsertedCount == 0 {
-		slog.Error("upsert failed", "Collection", Collection, "doc", doc)
+		slog.ErrorContext(ctx, "upsert failed", "Collection", Collection, "doc", doc)
 		return ErrUpsertFailed
 	}
 	return nil
 }
 
-func (d *Database) Replace(Collection, field, value string, doc interface{}) error {
+func (d *Database) Replace(ctx context.Context, Collection, field, value string, doc interface{}) error {
 	if value != "" {
-		d.GetCollection(Collection).DeleteMany(context.TODO(), bson.D{{field, value}})
+		d.GetCollection(Collection).DeleteMany(ctx, bson.D{{field, value}})
 	} else {
-		slog.Info("DB Replace value is empty %s: field %s ", Collection, field)
+		slog.InfoContext(ctx, "DB Replace value is empty", "collection", Collection, "field", field)
 	}
-	return d.Upsert(Collection, field, value, doc)
+	return d.Upsert(ctx, Collection, field, value, doc)
 }
 
-func (d *Database) GetValue(Collection, field string, value interface{}, proj string) (interface{}, error) {
+func (d *Database) GetValue(ctx context.Context, Collection, field string, value interface{}, proj string) (interface{}, error) {
 	doc := bson.M{}
-	err := d.GetCollection(Collection).FindOne(context.TODO(), bson.D{{field, value}}, options.FindOne().SetProjection(bson.D{{proj, 1}})).Decode(&doc)
+	err := d.GetCollection(Collection).FindOne(ctx, bson.D{{field, value}}, options.FindOne().SetProjection(bson.D{{proj, 1}})).Decode(&doc)
 	if err != nil {
 		return nil, err
 	}
@@ -193,9 +108,9 @@ func (d *Database) GetValue(Collection, field string, value interface{}, proj st
 	return val, err
 }
 
-func (d *Database) SetValue(Collection, id, field string, value interface{}) (interface{}, error) {
+func (d *Database) SetValue(ctx context.Context, Collection, id, field string, value interface{}) (interface{}, error) {
 
-	res, err := d.GetCollection(Collection).UpdateOne(context.TODO(), bson.D{{"_id", id}}, bson.D{{"$set", bson.D{{field, value}}}})
+	res, err := d.GetCollection(Collection).UpdateOne(ctx, bson.D{{"_id", id}}, bson.D{{"$set", bson.D{{field, value}}}})
 	if err != nil {
 		return nil, err
 	}
@@ -206,17 +121,17 @@ func (d *Database) SetValue(Collection, id, field string, value interface{}) (in
 func (d *Database) Projections() *mongo.Collection {
 	return d.GetCollection(nues.colProjections)
 }
-func (d *Database) Disconnect() error {
-	return d.Client().Disconnect(context.TODO())
+func (d *Database) Disconnect(ctx context.Context) error {
+	return d.Client().Disconnect(ctx)
 }
 
-func (d *Database) AddIndex(field string, collection string) error {
+func (d *Database) AddIndex(ctx context.Context, field string, collection string) error {
 	index := mongo.IndexModel{
 		Keys: bson.D{
 			{field, 1},
 		},
 	}
-	_, err := d.GetCollection(collection).Indexes().CreateOne(context.Background(), index)
+	_, err := d.GetCollection(collection).Indexes().CreateOne(ctx, index)
 	if err != nil {
 		return err
 	}
@@ -263,19 +178,46 @@ func initNuesIndexes() {
 	}
 	_, err := DB.GetCollection(nues.colEvents).Indexes().CreateOne(context.Background(), index)
 	if err != nil {
-		slog.Error("create index failed", err)
+		slog.Error("create index failed", "err", err)
 		panic(err)
 	}
 
-	// index sb_commands
-	commandsIndexOptions := options.Index().SetExpireAfterSeconds(10 * 60)
-	commandsIndex := mongo.IndexModel{
-		Keys:    bson.M{"date": 1},
-		Options: commandsIndexOptions,
+	// the commands TTL index used to be created on events by mistake, events have no date so drop it
+	_, err = DB.GetCollection(nues.colEvents).Indexes().DropOne(context.Background(), "date_1")
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && (cmdErr.Code == errIndexNotFound || cmdErr.Code == errNamespaceNotFound)) {
+		slog.Error("drop index failed", "err", err)
+		panic(err)
 	}
-	_, err = DB.GetCollection(nues.colEvents).Indexes().CreateOne(context.Background(), commandsIndex)
-	if err != nil {
-		slog.Error("create index failed", err)
+
+	if err := initSequenceCounter(context.Background()); err != nil {
+		slog.Error("create index failed", "err", err)
+		panic(err)
+	}
+
+	if err := initServicesIndex(context.Background()); err != nil {
+		slog.Error("create index failed", "err", err)
+		panic(err)
+	}
+
+	if err := initOutboxIndexes(context.Background()); err != nil {
+		slog.Error("create index failed", "err", err)
+		panic(err)
+	}
+
+	if err := initJobsIndex(context.Background()); err != nil {
+		slog.Error("create index failed", "err", err)
+		panic(err)
+	}
+
+	if err := initDeadLettersIndex(context.Background()); err != nil {
+		slog.Error("create index failed", "err", err)
+		panic(err)
+	}
+
+	// index sb_commands
+	if err := initIdempotencyIndex(context.Background()); err != nil {
+		slog.Error("create index failed", "err", err)
 		panic(err)
 	}
 
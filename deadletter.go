@@ -0,0 +1,388 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// PoisonPark parks an event still failing a projection after the retries and goes on with the next ones
+	PoisonPark = "park"
+	// PoisonBlock stops the projection on the event until it is fixed, reads fail meanwhile
+	PoisonBlock = "block"
+
+	DeadLetterParked    = "parked"
+	DeadLetterReplayed  = "replayed"
+	DeadLetterDiscarded = "discarded"
+
+	defaultProjectionRetries = 3
+	projectionRetryDelay     = 200 * time.Millisecond
+	defaultDeadLettersLimit  = 100
+)
+
+// DeadLetter is an event a projection failed on, parked with the error until it is replayed or discarded
+type DeadLetter struct {
+	Id         string `bson:"_id" json:"id"`
+	Projection string `bson:"projection" json:"projection"`
+	// Collection is the collection the projection was writing to, a shadow one during a rebuild
+	Collection string    `bson:"collection" json:"collection"`
+	Event      Event     `bson:"event" json:"event"`
+	Error      string    `bson:"error" json:"error"`
+	Attempts   int       `bson:"attempts" json:"attempts"`
+	Status     string    `bson:"status" json:"status"`
+	Date       time.Time `bson:"date" json:"date"`
+	Modified   time.Time `bson:"modified" json:"modified"`
+}
+
+// projectionUpdateError is a failure of the projection code, as opposed to one storing its progress
+type projectionUpdateError struct {
+	err error
+}
+
+func (e projectionUpdateError) Error() string {
+	return e.err.Error()
+}
+
+func (e projectionUpdateError) Unwrap() error {
+	return e.err
+}
+
+func projectionRetries() int {
+	if nues.ProjectionRetries > 0 {
+		return nues.ProjectionRetries
+	}
+	return defaultProjectionRetries
+}
+
+func initDeadLettersIndex(ctx context.Context) error {
+	_, err := DB.GetCollection(nues.colDeadLetters).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "projection", Value: 1}, {Key: "status", Value: 1}, {Key: "event.sequence", Value: 1}},
+	})
+	return err
+}
+
+// handlePoisonEvent retries alone the first event of the batch the projection did not apply,
+// then parks it and checkpoints past it unless PoisonEvents blocks
+func handlePoisonEvent(ctx context.Context, p Projection, from, target int64, events []Event, checkpoint checkpointFunc, updateErr error) (int64, error) {
+	var ev *Event
+	for i := range events {
+		if events[i].Sequence > from {
+			ev = &events[i]
+			break
+		}
+	}
+	if ev == nil {
+		return from, updateErr
+	}
+
+	err := updateErr
+	attempts := 1
+	for ; attempts <= projectionRetries(); attempts++ {
+		slog.WarnContext(ctx, "projection update failed, retrying event", "proj", p.Name(), "event", ev.Id, "sequence", ev.Sequence, "attempt", attempts, "err", err)
+		select {
+		case <-ctx.Done():
+			return from, ctx.Err()
+		case <-time.After(projectionRetryDelay * time.Duration(attempts)):
+		}
+		var seq int64
+		seq, err = applyProjectionBatch(ctx, p, from, target, []Event{*ev}, checkpoint)
+		var retryErr projectionUpdateError
+		if err == nil || !errors.As(err, &retryErr) {
+			return seq, err
+		}
+	}
+
+	if nues.PoisonEvents == PoisonBlock {
+		return from, err
+	}
+	if err := parkEvent(ctx, p, *ev, attempts, err); err != nil {
+		return from, err
+	}
+	if err := checkpoint(ctx, from, ev.Sequence, target); err != nil {
+		return from, err
+	}
+	return ev.Sequence, nil
+}
+
+func parkEvent(ctx context.Context, p Projection, ev Event, attempts int, cause error) error {
+	slog.ErrorContext(ctx, "projection event parked", "proj", p.Name(), "event", ev.Id, "sequence", ev.Sequence, "err", cause)
+	now := time.Now()
+	// not bound to the transaction of a command reading the projection, it must survive its abort
+	bg := context.WithoutCancel(serviceContext())
+	_, err := DB.GetCollection(nues.colDeadLetters).UpdateOne(bg, bson.M{"_id": p.Name() + ":" + ev.Id},
+		bson.M{
+			"$set": bson.M{
+				"projection": p.Name(),
+				"collection": projectionWriterName(ctx, p.Name()),
+				"event":      ev,
+				"error":      cause.Error(),
+				"attempts":   attempts,
+				"status":     DeadLetterParked,
+				"modified":   now,
+			},
+			"$setOnInsert": bson.M{"date": now},
+		}, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	metricDeadLetters.WithLabelValues(p.Name()).Inc()
+	_, err = DB.GetCollection(nues.colProjections).UpdateOne(bg, bson.M{"_id": p.Name()}, bson.M{"$set": bson.M{"degraded": true}})
+	return err
+}
+
+// ListDeadLetters returns the dead letters of projection with status, all of them when empty, oldest event first
+func ListDeadLetters(ctx context.Context, projection, status string, limit int64) ([]DeadLetter, error) {
+	filter := bson.M{}
+	if projection != "" {
+		filter["projection"] = projection
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+	if limit <= 0 {
+		limit = defaultDeadLettersLimit
+	}
+	cur, err := DB.GetCollection(nues.colDeadLetters).Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "event.sequence", Value: 1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	letters := []DeadLetter{}
+	err = cur.All(ctx, &letters)
+	return letters, err
+}
+
+// FixDeadLetter replaces the data of a parked event, the event store is left untouched
+func FixDeadLetter(ctx context.Context, id string, data any) error {
+	res, err := DB.GetCollection(nues.colDeadLetters).UpdateOne(ctx, bson.M{"_id": id, "status": DeadLetterParked},
+		bson.M{"$set": bson.M{"event.data": data, "modified": time.Now()}})
+	if err != nil {
+		slog.ErrorContext(ctx, "dead letter fix failed", "err", err)
+		return ErrSystemInternal
+	}
+	if res.MatchedCount == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// ReplayDeadLetters applies the parked events again, the one of id or all of projection oldest first,
+// and returns how many were applied. They land after the events applied meanwhile.
+// It does not join the transaction of ctx.
+func ReplayDeadLetters(ctx context.Context, projection, id string) (int, error) {
+	filter := bson.M{"status": DeadLetterParked}
+	switch {
+	case id != "":
+		filter["_id"] = id
+	case projection != "":
+		filter["projection"] = projection
+	default:
+		return 0, ErrBadCommand
+	}
+	bg := serviceContext()
+	cur, err := DB.GetCollection(nues.colDeadLetters).Find(bg, filter, options.Find().SetSort(bson.D{{Key: "event.sequence", Value: 1}}))
+	if err != nil {
+		slog.ErrorContext(ctx, "dead letters lookup failed", "err", err)
+		return 0, ErrSystemInternal
+	}
+	letters := []DeadLetter{}
+	if err := cur.All(bg, &letters); err != nil {
+		slog.ErrorContext(ctx, "dead letters lookup failed", "err", err)
+		return 0, ErrSystemInternal
+	}
+	if id != "" && len(letters) == 0 {
+		return 0, ErrDeadLetterNotFound
+	}
+
+	replayed := 0
+	for _, letter := range letters {
+		if err := replayDeadLetter(bg, letter); err != nil {
+			slog.ErrorContext(ctx, "dead letter replay failed", "id", letter.Id, "err", err)
+			return replayed, err
+		}
+		replayed++
+	}
+	for _, name := range deadLetterProjections(letters) {
+		if err := clearDegraded(bg, name); err != nil {
+			slog.ErrorContext(ctx, "projection degraded flag not cleared", "proj", name, "err", err)
+		}
+	}
+	return replayed, nil
+}
+
+func replayDeadLetter(ctx context.Context, letter DeadLetter) error {
+	p, err := registeredProjection(letter.Projection)
+	if err != nil {
+		return err
+	}
+	if _, rebuilding := projRebuilds.Load(p.Name()); rebuilding {
+		return ErrRebuildRunning
+	}
+	m := projectionLock(p.Name())
+	m.Lock()
+	defer m.Unlock()
+	if projectionStore(p) == nil {
+		root, err := loadProjectionRoot(ctx, p)
+		if err != nil {
+			return err
+		}
+		if root.Rebuild.running() {
+			return ErrRebuildRunning
+		}
+	}
+
+	events := []Event{letter.Event}
+	if pc, ok := p.(ProjectionContext); ok {
+		err = projectionTransact(ctx, p, func(ctx context.Context) error {
+			_, err := pc.UpdateCtx(ctx, events)
+			return err
+		})
+	} else {
+		_, err = p.Update(events)
+	}
+	now := time.Now()
+	if err != nil {
+		slog.ErrorContext(ctx, "dead letter still failing", "id", letter.Id, "err", err)
+		_, errRecord := DB.GetCollection(nues.colDeadLetters).UpdateOne(ctx, bson.M{"_id": letter.Id},
+			bson.M{"$set": bson.M{"error": err.Error(), "modified": now}, "$inc": bson.M{"attempts": 1}})
+		if errRecord != nil {
+			return errRecord
+		}
+		return ErrProjectionFailed
+	}
+	_, err = DB.GetCollection(nues.colDeadLetters).UpdateOne(ctx, bson.M{"_id": letter.Id},
+		bson.M{"$set": bson.M{"status": DeadLetterReplayed, "modified": now}})
+	return err
+}
+
+// DiscardDeadLetter gives up on a parked event, the projection stays without it
+func DiscardDeadLetter(ctx context.Context, id string) error {
+	bg := serviceContext()
+	var letter DeadLetter
+	err := DB.GetCollection(nues.colDeadLetters).FindOneAndUpdate(bg, bson.M{"_id": id, "status": DeadLetterParked},
+		bson.M{"$set": bson.M{"status": DeadLetterDiscarded, "modified": time.Now()}}).Decode(&letter)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrDeadLetterNotFound
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "dead letter discard failed", "err", err)
+		return ErrSystemInternal
+	}
+	if err := clearDegraded(bg, letter.Projection); err != nil {
+		slog.ErrorContext(ctx, "projection degraded flag not cleared", "proj", letter.Projection, "err", err)
+	}
+	return nil
+}
+
+// clearDegraded unsets the degraded flag of the projection once none of its events is parked
+func clearDegraded(ctx context.Context, projection string) error {
+	parked, err := DB.GetCollection(nues.colDeadLetters).CountDocuments(ctx,
+		bson.M{"projection": projection, "status": DeadLetterParked}, options.Count().SetLimit(1))
+	if err != nil || parked > 0 {
+		return err
+	}
+	_, err = DB.GetCollection(nues.colProjections).UpdateOne(ctx, bson.M{"_id": projection}, bson.M{"$set": bson.M{"degraded": false}})
+	return err
+}
+
+func deadLetterProjections(letters []DeadLetter) []string {
+	names := []string{}
+	for _, letter := range letters {
+		if !slices.Contains(names, letter.Projection) {
+			names = append(names, letter.Projection)
+		}
+	}
+	return names
+}
+
+// QryDeadLetters lists the dead letters, served by the admin route nues_dead_letters
+type QryDeadLetters struct {
+	Projection string `json:"projection"`
+	Status     string `json:"status"`
+	Limit      int64  `json:"limit"`
+}
+
+func (q *QryDeadLetters) Handle(ctx context.Context) (QueryResponse, error) {
+	letters, err := ListDeadLetters(ctx, q.Projection, q.Status, q.Limit)
+	if err != nil {
+		slog.ErrorContext(ctx, "dead letters list failed", "err", err)
+		return nil, ErrSystemInternal
+	}
+	return QueryResponse{"dead_letters": letters}, nil
+}
+
+// CmdFixDeadLetter replaces the data of a parked event, served by the admin route nues_dead_letter_fix
+type CmdFixDeadLetter struct {
+	Id   string         `validate:"required" json:"id"`
+	Data map[string]any `validate:"required" json:"data"`
+}
+
+func (c *CmdFixDeadLetter) Handle(ctx context.Context) (CommandResponse, error) {
+	if err := FixDeadLetter(ctx, c.Id, c.Data); err != nil {
+		return nil, err
+	}
+	return map[string]any{"id": c.Id}, nil
+}
+
+// CmdReplayDeadLetters replays parked events by id or projection, served by the admin route nues_dead_letter_replay
+type CmdReplayDeadLetters struct {
+	Id         string `json:"id"`
+	Projection string `json:"projection"`
+}
+
+func (c *CmdReplayDeadLetters) Handle(ctx context.Context) (CommandResponse, error) {
+	replayed, err := ReplayDeadLetters(ctx, c.Projection, c.Id)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"replayed": replayed}, nil
+}
+
+// CmdDiscardDeadLetter discards a parked event, served by the admin route nues_dead_letter_discard
+type CmdDiscardDeadLetter struct {
+	Id string `validate:"required" json:"id"`
+}
+
+func (c *CmdDiscardDeadLetter) Handle(ctx context.Context) (CommandResponse, error) {
+	if err := DiscardDeadLetter(ctx, c.Id); err != nil {
+		return nil, err
+	}
+	return map[string]any{"id": c.Id, "status": DeadLetterDiscarded}, nil
+}
+
+// deadLetterRoutes are the admin routes added to every service
+func deadLetterRoutes() Routes {
+	return Routes{
+		"nues_dead_letters": {
+			Name:    "nues_dead_letters",
+			Admin:   true,
+			Call:    QUERY,
+			Handler: func() any { return &QryDeadLetters{} },
+		},
+		"nues_dead_letter_fix": {
+			Name:    "nues_dead_letter_fix",
+			Admin:   true,
+			Call:    COMMAND,
+			Handler: func() any { return &CmdFixDeadLetter{} },
+		},
+		"nues_dead_letter_replay": {
+			Name:    "nues_dead_letter_replay",
+			Admin:   true,
+			Call:    COMMAND,
+			Handler: func() any { return &CmdReplayDeadLetters{} },
+		},
+		"nues_dead_letter_discard": {
+			Name:    "nues_dead_letter_discard",
+			Admin:   true,
+			Call:    COMMAND,
+			Handler: func() any { return &CmdDiscardDeadLetter{} },
+		},
+	}
+}
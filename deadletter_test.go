@@ -0,0 +1,155 @@
+package nues
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testPickyRefused are the keys testPicky fails on
+var testPickyRefused = map[string]bool{}
+
+// testPicky tallies like testTally but fails on the refused keys
+type testPicky struct {
+	testTally `bson:",inline"`
+}
+
+func (testPicky) Name() string { return "test_picky" }
+func (testPicky) Version() int { return 1 }
+
+func (p testPicky) Update(events []Event) (int64, error) {
+	var seq int64
+	for _, ev := range events {
+		data, err := decodeEventData[EvTestTallied](ev.Data)
+		if err != nil {
+			return seq, err
+		}
+		if testPickyRefused[data.Key] {
+			return seq, fmt.Errorf("key %s refused", data.Key)
+		}
+		_, err = DB.GetCollection(p.Name()).UpdateOne(context.Background(), bson.M{"_id": data.Key},
+			bson.M{"$inc": bson.M{"n": 1}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return seq, err
+		}
+		seq = ev.Sequence
+	}
+	return seq, nil
+}
+
+// parkTestPicky builds testPicky over an event it refuses and returns the dead letter parked for it
+func parkTestPicky(t *testing.T) DeadLetter {
+	t.Helper()
+	setupTestDB(t, "picky", Routes{})
+	nues.ProjectionRetries = 1
+	testPickyRefused = map[string]bool{"poison": true}
+	t.Cleanup(func() { testPickyRefused = map[string]bool{} })
+	ctx := context.Background()
+
+	err := RegisterEvents(ctx, EvTestTallied{Key: "a"}, EvTestTallied{Key: "poison"}, EvTestTallied{Key: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the projection goes on past the parked event
+	if err := BuildProjection[testPicky](ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectPicky(t, map[string]int{"a": 1, "b": 1})
+	expectDegraded(t, true)
+
+	letters, err := ListDeadLetters(ctx, testPicky{}.Name(), DeadLetterParked, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Event.Sequence != 2 || letters[0].Attempts != 2 || letters[0].Error != "key poison refused" {
+		t.Fatalf("dead letters %+v", letters)
+	}
+	return letters[0]
+}
+
+func expectPicky(t *testing.T, want map[string]int) {
+	t.Helper()
+	all, err := GetProjection[testPicky](context.Background(), mongo.Pipeline{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int{}
+	for _, tally := range all {
+		got[tally.Id] = tally.N
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("tallies %v, want %v", got, want)
+	}
+}
+
+func expectDegraded(t *testing.T, want bool) {
+	t.Helper()
+	root, err := loadProjectionRoot(context.Background(), testPicky{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Degraded != want {
+		t.Fatalf("degraded %v, want %v", root.Degraded, want)
+	}
+}
+
+func expectLetter(t *testing.T, id, status string, attempts int) {
+	t.Helper()
+	var letter DeadLetter
+	if err := DB.GetCollection(nues.colDeadLetters).FindOne(context.Background(), bson.M{"_id": id}).Decode(&letter); err != nil {
+		t.Fatal(err)
+	}
+	if letter.Status != status || letter.Attempts != attempts {
+		t.Fatalf("dead letter %s %+v, want %s after %d attempts", id, letter, status, attempts)
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	letter := parkTestPicky(t)
+	ctx := context.Background()
+
+	// still failing, the attempt is recorded and the event stays parked
+	if _, err := ReplayDeadLetters(ctx, "", letter.Id); err != ErrProjectionFailed {
+		t.Fatalf("err = %v, want %v", err, ErrProjectionFailed)
+	}
+	expectLetter(t, letter.Id, DeadLetterParked, 3)
+	expectDegraded(t, true)
+
+	testPickyRefused["poison"] = false
+	replayed, err := ReplayDeadLetters(ctx, testPicky{}.Name(), "")
+	if err != nil || replayed != 1 {
+		t.Fatalf("replayed %d, err %v", replayed, err)
+	}
+	expectLetter(t, letter.Id, DeadLetterReplayed, 3)
+	expectPicky(t, map[string]int{"a": 1, "b": 1, "poison": 1})
+	expectDegraded(t, false)
+
+	// replayed once
+	if _, err := ReplayDeadLetters(ctx, "", letter.Id); err != ErrDeadLetterNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrDeadLetterNotFound)
+	}
+}
+
+func TestDeadLetterDiscard(t *testing.T) {
+	letter := parkTestPicky(t)
+	ctx := context.Background()
+
+	if err := DiscardDeadLetter(ctx, letter.Id); err != nil {
+		t.Fatal(err)
+	}
+	expectLetter(t, letter.Id, DeadLetterDiscarded, 2)
+	expectPicky(t, map[string]int{"a": 1, "b": 1})
+	expectDegraded(t, false)
+
+	if err := DiscardDeadLetter(ctx, letter.Id); err != ErrDeadLetterNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrDeadLetterNotFound)
+	}
+	if _, err := ReplayDeadLetters(ctx, "", letter.Id); err != ErrDeadLetterNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrDeadLetterNotFound)
+	}
+}
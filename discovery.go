@@ -0,0 +1,278 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	BalanceRoundRobin   = "round_robin"
+	BalanceLeastPending = "least_pending"
+
+	colServices       = "__services"
+	defaultServiceTTL = 30 * time.Second
+	serviceWatchRetry = 5 * time.Second
+)
+
+// serviceRegistry is the local view of the live instances of every service, kept in sync with colServices
+type serviceRegistry struct {
+	mu        sync.RWMutex
+	instances map[string]NuesService
+	// next is the round robin position per service name
+	next sync.Map
+	// pending counts the calls in flight per instance id
+	pending sync.Map
+	// synced is set while the change stream feeding the registry is open
+	synced atomic.Bool
+	// lastHeartbeat is the unix nano time of the last successful heartbeat of this instance
+	lastHeartbeat atomic.Int64
+	// lastTick is the unix nano time the heartbeat loop last ran, failed or not, liveness checks it
+	lastTick atomic.Int64
+}
+
+var registry = &serviceRegistry{
+	instances: map[string]NuesService{},
+}
+
+func serviceTTL() time.Duration {
+	if nues.ServiceTTL > 0 {
+		return nues.ServiceTTL
+	}
+	return defaultServiceTTL
+}
+
+func selfService() NuesService {
+	return NuesService{
+		Id:        nues.ServiceId,
+		Name:      nues.ServiceName,
+		Ip:        nues.IP,
+		Port:      nues.RpcPort,
+		ExpiresAt: time.Now().Add(serviceTTL()),
+	}
+}
+
+// initServicesIndex lets mongo drop the instances that stopped sending heartbeats
+func initServicesIndex(ctx context.Context) error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	_, err := DB.Collection(colServices).Indexes().CreateOne(ctx, index)
+	return err
+}
+
+// registerSelf publishes this instance and refreshes it every third of the TTL until ctx is done
+func registerSelf(ctx context.Context) {
+	if err := heartbeat(ctx); err != nil {
+		panic(err)
+	}
+	slog.Debug("self service injected successfully")
+
+	go func() {
+		ticker := time.NewTicker(serviceTTL() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := heartbeat(ctx); err != nil && ctx.Err() == nil {
+					slog.Error("service heartbeat failed", "err", err)
+				}
+				registry.lastTick.Store(time.Now().UnixNano())
+			}
+		}
+	}()
+}
+
+func heartbeat(ctx context.Context) error {
+	self := selfService()
+	_, err := DB.Collection(colServices).UpdateOne(ctx, bson.M{"_id": self.Id}, bson.M{"$set": self}, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	registry.lastHeartbeat.Store(time.Now().UnixNano())
+	return nil
+}
+
+// deregisterSelf removes this instance so callers stop picking it before the servers close
+func deregisterSelf(ctx context.Context) error {
+	_, err := DB.Collection(colServices).DeleteOne(ctx, bson.M{"_id": nues.ServiceId})
+	return err
+}
+
+// watchServices loads the live instances then follows colServices changes until ctx is done,
+// the stream is reopened with a full reload when it fails
+func watchServices(ctx context.Context) {
+	if err := registry.load(ctx); err != nil {
+		panic(err)
+	}
+	go func() {
+		for {
+			err := registry.follow(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("services watch failed", "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(serviceWatchRetry):
+			}
+		}
+	}()
+}
+
+type serviceChange struct {
+	OperationType string       `bson:"operationType"`
+	FullDocument  *NuesService `bson:"fullDocument"`
+	DocumentKey   struct {
+		Id string `bson:"_id"`
+	} `bson:"documentKey"`
+}
+
+// load replaces the registry content with the live instances stored in colServices
+func (reg *serviceRegistry) load(ctx context.Context) error {
+	var services []NuesService
+	cur, err := DB.Collection(colServices).Find(ctx, bson.M{"expires_at": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if err := cur.All(ctx, &services); err != nil {
+		return err
+	}
+	reg.mu.Lock()
+	reg.instances = make(map[string]NuesService, len(services))
+	for _, s := range services {
+		reg.instances[s.Id] = s
+	}
+	reg.mu.Unlock()
+	slog.Debug("services loaded successfully", "services", services)
+	return nil
+}
+
+// follow applies colServices changes to the registry, it blocks until the stream fails or ctx is done
+func (reg *serviceRegistry) follow(ctx context.Context) error {
+	st, err := DB.Collection(colServices).Watch(ctx, mongo.Pipeline{}, options.ChangeStream().SetFullDocument(options.UpdateLookup))
+	if err != nil {
+		return err
+	}
+	defer st.Close(context.WithoutCancel(ctx))
+	// reload once the stream is open so no change before it is lost
+	if err := reg.load(ctx); err != nil {
+		return err
+	}
+	reg.synced.Store(true)
+	defer reg.synced.Store(false)
+
+	for st.Next(ctx) {
+		var change serviceChange
+		if err := st.Decode(&change); err != nil {
+			slog.Error("services change decode failed", "err", err)
+			continue
+		}
+		reg.apply(change)
+	}
+	if err := st.Err(); err != nil {
+		return err
+	}
+	return errors.New("services change stream closed")
+}
+
+func (reg *serviceRegistry) apply(change serviceChange) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	switch change.OperationType {
+	case "insert", "update", "replace":
+		if change.FullDocument != nil {
+			reg.instances[change.FullDocument.Id] = *change.FullDocument
+			return
+		}
+		delete(reg.instances, change.DocumentKey.Id)
+	case "delete":
+		delete(reg.instances, change.DocumentKey.Id)
+		reg.pending.Delete(change.DocumentKey.Id)
+	case "drop", "invalidate":
+		reg.instances = map[string]NuesService{}
+	}
+}
+
+// live returns the instances of name whose heartbeat has not expired
+func (reg *serviceRegistry) live(name string) []NuesService {
+	now := time.Now()
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	live := []NuesService{}
+	for _, s := range reg.instances {
+		if s.Name == name && s.ExpiresAt.After(now) {
+			live = append(live, s)
+		}
+	}
+	return live
+}
+
+func (reg *serviceRegistry) count() int {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return len(reg.instances)
+}
+
+// pick selects an instance of name with the configured balancing, instances with an open breaker are skipped
+// unless none is left
+func (reg *serviceRegistry) pick(name string) (*NuesService, bool) {
+	instances := reg.live(name)
+	if len(instances) == 0 {
+		return nil, false
+	}
+	closed := instances[:0:0]
+	for _, s := range instances {
+		if !breakerFor(s.Id).isOpen() {
+			closed = append(closed, s)
+		}
+	}
+	if len(closed) > 0 {
+		instances = closed
+	}
+	// map order is random, sort so round robin walks a stable order
+	slices.SortFunc(instances, func(a, b NuesService) int {
+		return strings.Compare(a.Id, b.Id)
+	})
+
+	if nues.LoadBalancing == BalanceLeastPending {
+		best := 0
+		for i := range instances {
+			if reg.inFlight(instances[i].Id).Load() < reg.inFlight(instances[best].Id).Load() {
+				best = i
+			}
+		}
+		return &instances[best], true
+	}
+	counter, _ := reg.next.LoadOrStore(name, &atomic.Uint64{})
+	i := counter.(*atomic.Uint64).Add(1) - 1
+	return &instances[i%uint64(len(instances))], true
+}
+
+func (reg *serviceRegistry) inFlight(instanceId string) *atomic.Int64 {
+	n, _ := reg.pending.LoadOrStore(instanceId, &atomic.Int64{})
+	return n.(*atomic.Int64)
+}
+
+// acquire counts a call to the instance, the returned func ends it
+func (reg *serviceRegistry) acquire(instanceId string) func() {
+	n := reg.inFlight(instanceId)
+	n.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { n.Add(-1) })
+	}
+}
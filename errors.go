@@ -25,12 +25,21 @@ func NewError(code int, message string) SysError {
 }
 
 var (
-	ErrSystemInternal   = NewError(0, "system error")
-	ErrBadCommand       = NewError(1, "can't process your request")
-	ErrUserNotAuth      = NewError(2, "not authorized")
-	ErrParsingData      = NewError(3, "cannot parse data")
-	ErrProjectionFailed = NewError(4, "projection failed")
-	ErrUpsertFailed     = NewError(5, "upsert failed")
-	ErrPhoneBadFormat   = NewError(6, "phone format not supported")
-	ErrIdentityNotFound = NewError(7, "identity id is required")
+	ErrSystemInternal     = NewError(0, "system error")
+	ErrBadCommand         = NewError(1, "can't process your request")
+	ErrUserNotAuth        = NewError(2, "not authorized")
+	ErrParsingData        = NewError(3, "cannot parse data")
+	ErrProjectionFailed   = NewError(4, "projection failed")
+	ErrUpsertFailed       = NewError(5, "upsert failed")
+	ErrPhoneBadFormat     = NewError(6, "phone format not supported")
+	ErrIdentityNotFound   = NewError(7, "identity id is required")
+	ErrCallConflict       = NewError(8, "callId already used with another payload")
+	ErrCallInProgress     = NewError(9, "call with this callId is in progress")
+	ErrServiceNotFound    = NewError(10, "service not found")
+	ErrCircuitOpen        = NewError(11, "service unavailable")
+	ErrJobNotFound        = NewError(12, "job not found")
+	ErrProjectionLagging  = NewError(13, "projection not up to date")
+	ErrProjectionUnknown  = NewError(14, "projection not found")
+	ErrRebuildRunning     = NewError(15, "projection rebuild in progress")
+	ErrDeadLetterNotFound = NewError(16, "dead letter not found")
 )
@@ -2,17 +2,24 @@ package nues
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// colCounters holds the sequence counter of the events
+const colCounters = "__counters"
+
 var EvAttemptName string = "EvAttempt"
 
 type EvAttempt struct {
@@ -321,20 +328,17 @@ type EvSendRatesUpdated struct {
 	SendAgentFeePercent float64 `json:"send_agent_fee_percent"`
 }
 
-var evMutex sync.Mutex
-
 type Event struct {
 	Id        string      `bson:"_id" json:"id"`
 	Name      string      `bson:"name" json:"name"`
 	Sequence  int64       `bson:"sequence" json:"sequence"`
 	Timestamp time.Time   `bson:"timestamp" json:"timestamp"`
 	Data      interface{} `bson:"data" json:"data"`
+	// Trace carries the trace context of the request that produced the event
+	Trace map[string]string `bson:"trace,omitempty" json:"trace,omitempty"`
 }
 
 func (e *Event) save(ctx context.Context) error {
-	defer evMutex.Unlock()
-	evMutex.Lock()
-
 	if len(e.Id) == 0 {
 		return fmt.Errorf("event id is empty")
 	}
@@ -350,44 +354,182 @@ func (e *Event) save(ctx context.Context) error {
 	return err
 }
 
-func RegisterEvents(ctx context.Context, evs ...interface{}) error {
+type sequenceTrackerKey struct{}
+
+// sequenceTracker holds the events a command registers until it commits, and the sequence of the last one
+type sequenceTracker struct {
+	last    atomic.Int64
+	mu      sync.Mutex
+	pending []interface{}
+}
+
+func withSequenceTracker(ctx context.Context) (context.Context, *sequenceTracker) {
+	tracker := &sequenceTracker{}
+	return context.WithValue(ctx, sequenceTrackerKey{}, tracker), tracker
+}
+
+func (t *sequenceTracker) add(evs []interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, evs...)
+}
+
+// flush saves the pending events right before the command commits, the sequence counter is then
+// locked for the commit only and not while the handler runs
+func (t *sequenceTracker) flush(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.pending) == 0 {
+		return nil
+	}
+	return registerEvents(ctx, t.pending)
+}
+
+// RegisterEvents saves the events with the next sequences, in a command they are saved when it commits
+func RegisterEvents(ctx context.Context, evs ...interface{}) (err error) {
+
+	ctx, span := startSpan(ctx, "events register", trace.SpanKindProducer, attribute.Int("nues.events", len(evs)))
+	defer func() {
+		endSpan(span, err)
+	}()
 
-	last := GetLastSequence()
 	for _, ev := range evs {
-		last = last + 1
-		evName := reflect.TypeOf(ev).Name()
-		if len(evName) == 0 {
+		if len(reflect.TypeOf(ev).Name()) == 0 {
 			panic("unknown event name")
 		}
+	}
+	if tracker, ok := ctx.Value(sequenceTrackerKey{}).(*sequenceTracker); ok && mongo.SessionFromContext(ctx) != nil {
+		// saved when the command commits
+		tracker.add(evs)
+		return nil
+	}
+	if mongo.SessionFromContext(ctx) != nil {
+		err := registerEvents(ctx, evs)
+		if hasErrorLabel(err, "TransientTransactionError") {
+			return sequenceConflict{err: err}
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "event save failed", "err", err)
+			return ErrSystemInternal
+		}
+		return nil
+	}
+
+	// events registered outside of a command get their own transaction, their sequences commit in order too
+	session, err := DB.Client().StartSession()
+	if err != nil {
+		slog.ErrorContext(ctx, "event session creation error", "err", err)
+		return ErrSystemInternal
+	}
+	defer session.EndSession(context.WithoutCancel(ctx))
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (any, error) {
+		return nil, registerEvents(ctx, evs)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "event save failed", "err", err)
+		return ErrSystemInternal
+	}
+	return nil
+}
+
+func registerEvents(ctx context.Context, evs []interface{}) error {
+	traceCarrier := injectTrace(ctx)
+	first, err := nextSequences(ctx, int64(len(evs)))
+	if err != nil {
+		return err
+	}
+	last := first - 1
+	for _, ev := range evs {
+		last = last + 1
 		e := &Event{
 			Id:        GenerateId(),
-			Name:      evName,
+			Name:      reflect.TypeOf(ev).Name(),
 			Sequence:  last,
 			Timestamp: time.Now(),
 			Data:      ev,
+			Trace:     traceCarrier,
 		}
 		if err := e.save(ctx); err != nil {
-			slog.Error("event save failed", err)
-			return ErrSystemInternal
+			return err
 		}
 	}
+	if tracker, ok := ctx.Value(sequenceTrackerKey{}).(*sequenceTracker); ok {
+		tracker.last.Store(last)
+	}
 	return nil
+}
 
+// sequenceConflict is returned when a concurrent transaction holds the sequence counter, the transaction
+// has to be retried. It unwraps to the driver error so mongo.Session.WithTransaction retries it.
+type sequenceConflict struct {
+	err error
 }
 
-func GetLastSequence() int64 {
-	defer evMutex.Unlock()
-	evMutex.Lock()
+func (e sequenceConflict) Error() string {
+	return ErrSystemInternal.Error()
+}
+
+func (e sequenceConflict) Unwrap() error {
+	return e.err
+}
 
-	var res bson.M
-	err := DB.GetCollection(nues.colEvents).FindOne(context.TODO(), bson.D{}, options.FindOne().SetProjection(bson.D{{"sequence", 1}}).SetSort(bson.D{{"sequence", -1}})).Decode(&res)
+// hasErrorLabel tells if the driver labelled err, TransientTransactionError ones succeed when the transaction runs again
+func hasErrorLabel(err error, label string) bool {
+	var le mongo.LabeledError
+	return errors.As(err, &le) && le.HasErrorLabel(label)
+}
+
+// nextSequences reserves n sequences on the counter and returns the first one. In a transaction the
+// counter stays locked until it commits, so events commit in the order of their sequences. Commands
+// reserve them when they commit, see sequenceTracker.
+func nextSequences(ctx context.Context, n int64) (int64, error) {
+	var counter struct {
+		Sequence int64 `bson:"sequence"`
+	}
+	err := DB.Collection(colCounters).FindOneAndUpdate(ctx, bson.M{"_id": DB.Events().Name()},
+		bson.M{"$inc": bson.M{"sequence": n}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&counter)
 	if err != nil {
-		switch err {
-		case mongo.ErrNoDocuments:
-			return 0
-		default:
-			panic(err)
-		}
+		return 0, err
+	}
+	return counter.Sequence - n + 1, nil
+}
+
+// initSequenceCounter starts the counter after the events registered before it existed, and makes
+// sequences unique
+func initSequenceCounter(ctx context.Context) error {
+	last, err := GetLastSequence(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Collection(colCounters).UpdateOne(ctx, bson.M{"_id": DB.Events().Name()},
+		bson.M{"$max": bson.M{"sequence": last}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	_, err = DB.Events().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "sequence", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		// registered before the counter, projections may have skipped some of these events
+		slog.Error("events share sequences, sequence index not unique", "err", err)
+		return nil
+	}
+	return err
+}
+
+// GetLastSequence returns the sequence of the last event registered
+func GetLastSequence(ctx context.Context) (int64, error) {
+	var res struct {
+		Sequence int64 `bson:"sequence"`
+	}
+	err := DB.GetCollection(nues.colEvents).FindOne(ctx, bson.D{}, options.FindOne().SetProjection(bson.D{{"sequence", 1}}).SetSort(bson.D{{"sequence", -1}})).Decode(&res)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
 	}
-	return res["sequence"].(int64)
+	return res.Sequence, nil
 }
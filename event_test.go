@@ -0,0 +1,109 @@
+package nues
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type EvTestRegistered struct {
+	N int `json:"n"`
+}
+
+func TestRegisterEventsConcurrentSequences(t *testing.T) {
+	setupTestDB(t, "events", Routes{})
+	ctx := context.Background()
+
+	const writers, perWriter = 20, 3
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			evs := []any{}
+			for j := 0; j < perWriter; j++ {
+				evs = append(evs, EvTestRegistered{N: i*perWriter + j})
+			}
+			errs <- RegisterEvents(ctx, evs...)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cur, err := DB.Events().Find(ctx, bson.M{"name": "EvTestRegistered"}, options.Find().SetSort(bson.D{{Key: "sequence", Value: 1}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []Event{}
+	if err := cur.All(ctx, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != writers*perWriter {
+		t.Fatalf("%d events registered", len(events))
+	}
+	for i, ev := range events {
+		if ev.Sequence != int64(i+1) {
+			t.Fatalf("event %d has sequence %d, sequences must be unique and without gaps", i, ev.Sequence)
+		}
+	}
+}
+
+type CmdTestRegister struct {
+	N int `json:"n"`
+}
+
+func (c *CmdTestRegister) Handle(ctx context.Context) (CommandResponse, error) {
+	if err := RegisterEvents(ctx, EvTestRegistered{N: c.N}); err != nil {
+		return nil, err
+	}
+	// the counter is not held while the handler works
+	time.Sleep(50 * time.Millisecond)
+	return map[string]any{"n": c.N}, nil
+}
+
+func TestConcurrentCommandsRegisterEvents(t *testing.T) {
+	setupTestDB(t, "events", Routes{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const commands = 20
+	roots := make([]*CommandRoot, commands)
+	var wg sync.WaitGroup
+	for i := range roots {
+		roots[i] = &CommandRoot{Command: &CmdTestRegister{N: i}}
+		wg.Add(1)
+		go func(cr *CommandRoot) {
+			defer wg.Done()
+			cr.Execute(ctx)
+		}(roots[i])
+	}
+	wg.Wait()
+
+	sequences := map[int64]bool{}
+	for i, cr := range roots {
+		if !cr.Executed || cr.Error != nil {
+			t.Fatalf("command %d: executed %v, err %v", i, cr.Executed, cr.Error)
+		}
+		if cr.Sequence == 0 || sequences[cr.Sequence] {
+			t.Fatalf("command %d has sequence %d", i, cr.Sequence)
+		}
+		sequences[cr.Sequence] = true
+	}
+	n, err := DB.Events().CountDocuments(ctx, bson.M{"name": "EvTestRegistered"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != commands {
+		t.Fatalf("%d events registered", n)
+	}
+}
@@ -0,0 +1,248 @@
+package nues
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const (
+	healthCheckTimeout = 5 * time.Second
+	// defaultOpsPort is where orchestrators, load balancers and Prometheus find the health checks and metrics
+	defaultOpsPort = ":9090"
+)
+
+// NuesOps serves the health and metrics endpoints on nues.OpsPort, apart from the public API
+type NuesOps struct {
+	server *http.Server
+}
+
+func opsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/healthz", liveness)
+	mux.HandleFunc("/readyz", readiness)
+	return mux
+}
+
+func (o *NuesOps) Serve(ctx context.Context) {
+	o.server = &http.Server{
+		Addr:              nues.OpsPort,
+		Handler:           opsHandler(),
+		ReadHeaderTimeout: apiHeaderTimeout,
+		WriteTimeout:      2 * healthCheckTimeout,
+	}
+	slog.Info("starting ops server ...", "port", nues.OpsPort)
+	err := o.server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		panic(err)
+	}
+}
+
+func (o *NuesOps) Close() error {
+	if o.server == nil {
+		return nil
+	}
+	return o.server.Close()
+}
+
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type HealthReport struct {
+	Status    string        `json:"status"`
+	ServiceId string        `json:"service_id"`
+	Checks    []HealthCheck `json:"checks,omitempty"`
+}
+
+type watcherState struct {
+	Running   bool
+	Err       string
+	LastEvent time.Time
+	// Restarts counts the reconnections of the watcher
+	Restarts int
+	// Standby watchers wait for the replica holding their lease to stop
+	Standby bool
+}
+
+// watcherStates holds the last known watcherState of every watcher started by this process
+var watcherStates sync.Map
+
+func setWatcherState(eventName string, update func(*watcherState)) {
+	state := watcherState{}
+	if s, ok := watcherStates.Load(eventName); ok {
+		state = s.(watcherState)
+	}
+	update(&state)
+	watcherStates.Store(eventName, state)
+}
+
+// liveness fails when a restart is due: the service is stopping or its heartbeat loop stalled.
+// Dependencies like mongo are left to readiness, a restart would not bring them back.
+func liveness(w http.ResponseWriter, r *http.Request) {
+	report := HealthReport{
+		Status:    "ok",
+		ServiceId: nues.ServiceId,
+		Checks:    []HealthCheck{checkProcess()},
+	}
+	if !report.Checks[0].Ok {
+		report.Status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeHealth(w, report)
+}
+
+func readiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	report := HealthReport{
+		Status:    "ok",
+		ServiceId: nues.ServiceId,
+		Checks: []HealthCheck{
+			checkMongo(ctx),
+			checkTransactions(ctx),
+			checkServices(),
+		},
+	}
+	report.Checks = append(report.Checks, checkWatchers()...)
+	report.Checks = append(report.Checks, checkProjections(ctx)...)
+
+	for _, c := range report.Checks {
+		if !c.Ok {
+			report.Status = "unavailable"
+			w.WriteHeader(http.StatusServiceUnavailable)
+			break
+		}
+	}
+	writeHealth(w, report)
+}
+
+func writeHealth(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("health response error", "err", err)
+	}
+}
+
+func checkProcess() HealthCheck {
+	check := HealthCheck{Name: "process"}
+	if nues.context != nil && nues.context.Err() != nil {
+		check.Detail = "shutting down"
+		return check
+	}
+	// a heartbeat failing is fine, one not even attempted means the process is stuck
+	if tick := registry.lastTick.Load(); tick != 0 {
+		if age := time.Since(time.Unix(0, tick)); age > 3*serviceTTL() {
+			check.Detail = fmt.Sprintf("heartbeat loop stalled for %s", age.Round(time.Second))
+			return check
+		}
+	}
+	check.Ok = true
+	return check
+}
+
+func checkMongo(ctx context.Context) HealthCheck {
+	check := HealthCheck{Name: "mongo"}
+	if err := DB.Client().Ping(ctx, readpref.Primary()); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.Ok = true
+	return check
+}
+
+// checkTransactions verifies the deployment is a replica set or sharded cluster, commands need transactions
+func checkTransactions(ctx context.Context) HealthCheck {
+	check := HealthCheck{Name: "transactions"}
+	var hello bson.M
+	if err := DB.RunCommand(ctx, bson.M{"hello": 1}).Decode(&hello); err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	if _, ok := hello["setName"]; ok {
+		check.Ok = true
+		return check
+	}
+	if msg, _ := hello["msg"].(string); msg == "isdbgrid" {
+		check.Ok = true
+		return check
+	}
+	check.Detail = "mongo is not a replica set"
+	return check
+}
+
+func checkServices() HealthCheck {
+	check := HealthCheck{Name: "services"}
+	if !registry.synced.Load() {
+		check.Detail = "services change stream not open"
+		return check
+	}
+	// this instance must still be discoverable
+	beat := registry.lastHeartbeat.Load()
+	if beat == 0 {
+		check.Detail = "service not registered"
+		return check
+	}
+	if age := time.Since(time.Unix(0, beat)); age > serviceTTL() {
+		check.Detail = fmt.Sprintf("last heartbeat %s ago", age.Round(time.Second))
+		return check
+	}
+	check.Ok = true
+	check.Detail = fmt.Sprintf("%d instances", registry.count())
+	return check
+}
+
+func checkWatchers() []HealthCheck {
+	checks := []HealthCheck{}
+	watcherStates.Range(func(key, value any) bool {
+		state := value.(watcherState)
+		check := HealthCheck{
+			Name: "watcher " + key.(string),
+			Ok:   state.Running || state.Standby,
+		}
+		if state.Standby {
+			check.Detail = "standby"
+		} else if !state.Running {
+			check.Detail = fmt.Sprintf("reconnecting after %d restarts: %s", state.Restarts, state.Err)
+		} else if !state.LastEvent.IsZero() {
+			check.Detail = "last event at " + state.LastEvent.Format(time.RFC3339)
+		}
+		checks = append(checks, check)
+		return true
+	})
+	return checks
+}
+
+func checkProjections(ctx context.Context) []HealthCheck {
+	checks := []HealthCheck{}
+	if nues.MaxProjectionLag <= 0 {
+		return checks
+	}
+	projRegistry.Range(func(key, value any) bool {
+		name := key.(string)
+		check := HealthCheck{Name: "projection " + name}
+		lag, err := projectionLag(ctx, value.(Projection))
+		switch {
+		case err != nil:
+			check.Detail = err.Error()
+		case lag > nues.MaxProjectionLag:
+			check.Detail = fmt.Sprintf("%d events behind", lag)
+		default:
+			check.Ok = true
+		}
+		checks = append(checks, check)
+		return true
+	})
+	return checks
+}
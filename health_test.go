@@ -0,0 +1,51 @@
+package nues
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveness(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	saved := nues.context
+	nues.context = ctx
+	t.Cleanup(func() {
+		cancel()
+		nues.context = saved
+		registry.lastTick.Store(0)
+	})
+	ops := opsHandler()
+	status := func() int {
+		w := httptest.NewRecorder()
+		ops.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		return w.Code
+	}
+
+	registry.lastTick.Store(time.Now().UnixNano())
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("status %d, want %d", got, http.StatusOK)
+	}
+	// the heartbeat loop has not run for three TTLs
+	registry.lastTick.Store(time.Now().Add(-4 * serviceTTL()).UnixNano())
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Fatalf("stalled: status %d, want %d", got, http.StatusServiceUnavailable)
+	}
+	registry.lastTick.Store(time.Now().UnixNano())
+	cancel()
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Fatalf("shutting down: status %d, want %d", got, http.StatusServiceUnavailable)
+	}
+}
+
+func TestOpsServesMetrics(t *testing.T) {
+	metricRequests.WithLabelValues("test", "test_route").Inc()
+	w := httptest.NewRecorder()
+	opsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `route="test_route"`) {
+		t.Fatalf("status %d: %s", w.Code, w.Body.String())
+	}
+}
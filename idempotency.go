@@ -0,0 +1,190 @@
+package nues
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultIdempotencyTTL = 10 * time.Minute
+
+	callPending = "pending"
+	callDone    = "done"
+
+	// errIndexOptionsConflict is returned by mongo when an index exists with other options
+	errIndexOptionsConflict = 85
+	errIndexNotFound        = 27
+	errNamespaceNotFound    = 26
+)
+
+// callRecord is the document stored in colCommands for every command executed with a callId
+type callRecord struct {
+	Id          string    `bson:"_id"`
+	Status      string    `bson:"status"`
+	Hash        string    `bson:"hash"`
+	LockedUntil time.Time `bson:"locked_until"`
+	Date        time.Time `bson:"date"`
+}
+
+// callResult is what a replayed command returns
+type callResult struct {
+	Response CommandResponse
+	Executed bool
+	Error    SysError
+	Sequence int64
+}
+
+// fingerprint hashes the command type and payload so a reused callId with another payload is detected
+func fingerprint(cmdName string, cmd Command) (string, error) {
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(cmdName))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reserveCall takes the in-flight lock of callId, the lock lasts until the context deadline.
+// When the call already completed its stored result is returned instead.
+func reserveCall(ctx context.Context, callId, hash string) (*callResult, SysError) {
+
+	now := time.Now()
+	lockedUntil := now.Add(defaultRequestTimeout)
+	if deadline, ok := ctx.Deadline(); ok {
+		lockedUntil = deadline
+	}
+	record := callRecord{
+		Id:          callId,
+		Status:      callPending,
+		Hash:        hash,
+		LockedUntil: lockedUntil,
+		Date:        now,
+	}
+	col := DB.GetCollection(nues.colCommands)
+	_, err := col.InsertOne(ctx, record)
+	if err == nil {
+		return nil, nil
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		slog.ErrorContext(ctx, "call reservation failed", "err", err)
+		return nil, ErrSystemInternal
+	}
+
+	var existing bson.M
+	if err := col.FindOne(ctx, bson.M{"_id": callId}).Decode(&existing); err != nil {
+		slog.ErrorContext(ctx, "call lookup failed", "err", err)
+		return nil, ErrSystemInternal
+	}
+	if existing["hash"] != hash {
+		return nil, ErrCallConflict
+	}
+	if existing["status"] == callDone {
+		return decodeCallResult(existing), nil
+	}
+
+	// a pending call whose lock expired was abandoned, take it over
+	res, err := col.UpdateOne(ctx, bson.M{"_id": callId, "status": callPending, "locked_until": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"locked_until": lockedUntil, "date": now}})
+	if err != nil {
+		slog.ErrorContext(ctx, "call takeover failed", "err", err)
+		return nil, ErrSystemInternal
+	}
+	if res.ModifiedCount == 0 {
+		return nil, ErrCallInProgress
+	}
+	return nil, nil
+}
+
+func decodeCallResult(record bson.M) *callResult {
+	result := &callResult{
+		Response: record["response"],
+	}
+	result.Executed, _ = record["executed"].(bool)
+	result.Sequence, _ = record["sequence"].(int64)
+	if sysErr, ok := record["error"].(bson.M); ok {
+		var code int
+		switch c := sysErr["code"].(type) {
+		case int32:
+			code = int(c)
+		case int64:
+			code = int(c)
+		}
+		message, _ := sysErr["message"].(string)
+		result.Error = NewError(code, message)
+	}
+	return result
+}
+
+// completeCall stores the result of callId, run it inside the command transaction so it commits with it
+func completeCall(ctx context.Context, callId string, result callResult) error {
+	set := bson.M{
+		"status":   callDone,
+		"response": result.Response,
+		"executed": result.Executed,
+		"sequence": result.Sequence,
+		"date":     time.Now(),
+	}
+	var sysErr SysErrorData
+	if errors.As(result.Error, &sysErr) {
+		set["error"] = bson.M{"code": sysErr.Code, "message": sysErr.Message}
+	}
+	_, err := DB.GetCollection(nues.colCommands).UpdateOne(ctx, bson.M{"_id": callId}, bson.M{"$set": set})
+	return err
+}
+
+// releaseCall drops a pending reservation so the caller can retry
+func releaseCall(ctx context.Context, callId string) {
+	_, err := DB.GetCollection(nues.colCommands).DeleteOne(ctx, bson.M{"_id": callId, "status": callPending})
+	if err != nil {
+		slog.ErrorContext(ctx, "call release failed", "err", err)
+	}
+}
+
+// isFinalError tells if a failed command would fail the same way on retry, so its result is stored
+func isFinalError(ctx context.Context, err SysError) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var sysErr SysErrorData
+	if !errors.As(err, &sysErr) {
+		return false
+	}
+	return sysErr.Code != ErrSystemInternal.(SysErrorData).Code
+}
+
+func idempotencyTTL() time.Duration {
+	if nues.IdempotencyTTL > 0 {
+		return nues.IdempotencyTTL
+	}
+	return defaultIdempotencyTTL
+}
+
+// initIdempotencyIndex creates the TTL index of colCommands, updating its expiry when the TTL changed
+func initIdempotencyIndex(ctx context.Context) error {
+	ttl := int32(idempotencyTTL().Seconds())
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "date", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(ttl),
+	}
+	_, err := DB.GetCollection(nues.colCommands).Indexes().CreateOne(ctx, index)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == errIndexOptionsConflict {
+		err = DB.RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: DB.GetCollection(nues.colCommands).Name()},
+			{Key: "index", Value: bson.M{"keyPattern": bson.M{"date": 1}, "expireAfterSeconds": ttl}},
+		}).Err()
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type CmdTestCharge struct {
+	Amount int `json:"amount"`
+}
+
+// cmdTestCharges counts the CmdTestCharge handled, replays don't run the handler
+var cmdTestCharges atomic.Int64
+
+func (c *CmdTestCharge) Handle(ctx context.Context) (CommandResponse, error) {
+	cmdTestCharges.Add(1)
+	return map[string]any{"charged": c.Amount}, nil
+}
+
+func TestFingerprint(t *testing.T) {
+	hash := func(name string, cmd Command) string {
+		t.Helper()
+		h, err := fingerprint(name, cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	base := hash("CmdTestCharge", &CmdTestCharge{Amount: 5})
+	if base != hash("CmdTestCharge", &CmdTestCharge{Amount: 5}) {
+		t.Fatal("the same command has another fingerprint")
+	}
+	if base == hash("CmdTestCharge", &CmdTestCharge{Amount: 6}) {
+		t.Fatal("another payload has the same fingerprint")
+	}
+	if base == hash("CmdTestRefund", &CmdTestCharge{Amount: 5}) {
+		t.Fatal("another command has the same fingerprint")
+	}
+}
+
+func TestResponseStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err    SysError
+		status int
+	}{
+		{nil, http.StatusOK},
+		{ErrBadCommand, http.StatusOK},
+		{ErrCallConflict, http.StatusConflict},
+		{ErrCallInProgress, http.StatusConflict},
+	} {
+		if got := responseStatus(&CommandRoot{Error: tc.err}); got != tc.status {
+			t.Fatalf("status of %v = %d, want %d", tc.err, got, tc.status)
+		}
+	}
+}
+
+func TestReserveCall(t *testing.T) {
+	setupTestDB(t, "orders", Routes{})
+	ctx := context.Background()
+	callId := GenerateId()
+
+	if result, err := reserveCall(ctx, callId, "h1"); result != nil || err != nil {
+		t.Fatalf("new call reserved with %v, %v", result, err)
+	}
+	if _, err := reserveCall(ctx, callId, "h1"); err != ErrCallInProgress {
+		t.Fatalf("err = %v, want %v", err, ErrCallInProgress)
+	}
+	if _, err := reserveCall(ctx, callId, "h2"); err != ErrCallConflict {
+		t.Fatalf("err = %v, want %v", err, ErrCallConflict)
+	}
+
+	// an abandoned reservation is taken over once its lock expired
+	_, err := DB.GetCollection(nues.colCommands).UpdateOne(ctx, bson.M{"_id": callId},
+		bson.M{"$set": bson.M{"locked_until": time.Now().Add(-time.Second)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := reserveCall(ctx, callId, "h1"); result != nil || err != nil {
+		t.Fatalf("expired call reserved with %v, %v", result, err)
+	}
+
+	if err := completeCall(ctx, callId, callResult{Response: "done", Executed: true, Sequence: 7}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := reserveCall(ctx, callId, "h1")
+	if err != nil || result == nil {
+		t.Fatalf("completed call replayed with %v, %v", result, err)
+	}
+	if result.Response != "done" || !result.Executed || result.Sequence != 7 {
+		t.Fatalf("replayed %+v", result)
+	}
+	if _, err := reserveCall(ctx, callId, "h2"); err != ErrCallConflict {
+		t.Fatalf("err = %v, want %v", err, ErrCallConflict)
+	}
+}
+
+func TestCommandDedupe(t *testing.T) {
+	setupTestDB(t, "orders", Routes{})
+	ctx := context.Background()
+	callId := GenerateId()
+	before := cmdTestCharges.Load()
+
+	first := &CommandRoot{Command: &CmdTestCharge{Amount: 5}, CallId: callId}
+	first.Execute(ctx)
+	if first.Error != nil || !first.Executed || first.Replayed {
+		t.Fatalf("first call %+v", first)
+	}
+	again := &CommandRoot{Command: &CmdTestCharge{Amount: 5}, CallId: callId}
+	again.Execute(ctx)
+	if again.Error != nil || !again.Executed || !again.Replayed {
+		t.Fatalf("second call %+v", again)
+	}
+	if charged, _ := ParseM(again.Response); fmt.Sprint(charged["charged"]) != "5" {
+		t.Fatalf("replayed response %v", again.Response)
+	}
+	if n := cmdTestCharges.Load() - before; n != 1 {
+		t.Fatalf("command handled %d times", n)
+	}
+
+	other := &CommandRoot{Command: &CmdTestCharge{Amount: 6}, CallId: callId}
+	other.Execute(ctx)
+	if !errors.Is(other.Error, ErrCallConflict) || other.Executed {
+		t.Fatalf("call with another payload %+v", other)
+	}
+}
+
+func TestIdempotencyTTL(t *testing.T) {
+	setupTestDB(t, "orders", Routes{})
+	ctx := context.Background()
+
+	expiry := func() int64 {
+		t.Helper()
+		cur, err := DB.GetCollection(nues.colCommands).Indexes().List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexes := []bson.M{}
+		if err := cur.All(ctx, &indexes); err != nil {
+			t.Fatal(err)
+		}
+		for _, index := range indexes {
+			switch seconds := index["expireAfterSeconds"].(type) {
+			case int32:
+				return int64(seconds)
+			case int64:
+				return seconds
+			case float64:
+				return int64(seconds)
+			}
+		}
+		t.Fatal("no TTL index on the calls")
+		return 0
+	}
+	if got := expiry(); got != int64(defaultIdempotencyTTL.Seconds()) {
+		t.Fatalf("calls expire after %ds", got)
+	}
+	// a changed TTL updates the existing index
+	nues.IdempotencyTTL = time.Hour
+	if err := initIdempotencyIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := expiry(); got != int64(time.Hour.Seconds()) {
+		t.Fatalf("calls expire after %ds", got)
+	}
+}
@@ -0,0 +1,90 @@
+package nues
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogConfig builds the service logger when Nues.Logger is not set
+type LogConfig struct {
+	// Format is LogFormatText (default) or LogFormatJSON
+	Format string
+	// Level defaults to Warn, or Debug when Nues.Debug is set
+	Level slog.Leveler
+	// Output defaults to stdout
+	Output     io.Writer
+	HideSource bool
+}
+
+type logAttrsKey struct{}
+
+// WithLogAttrs returns a context whose log lines carry attrs in addition to the ones already attached
+func WithLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	parent, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(parent)+len(attrs))
+	merged = append(merged, parent...)
+	merged = append(merged, attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, merged)
+}
+
+// contextHandler adds the request attributes and trace id found in the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func initLogger() {
+	logger := nues.Logger
+	if logger == nil {
+		logger = slog.New(newLogHandler(nues.Log))
+	}
+	slog.SetDefault(slog.New(contextHandler{logger.Handler()}))
+}
+
+func newLogHandler(config LogConfig) slog.Handler {
+	level := config.Level
+	if level == nil {
+		level = slog.LevelWarn
+		if nues.Debug {
+			level = slog.LevelDebug
+		}
+	}
+	output := config.Output
+	if output == nil {
+		output = os.Stdout
+	}
+	opts := &slog.HandlerOptions{
+		Level:     level,
+		AddSource: !config.HideSource,
+	}
+	if config.Format == LogFormatJSON {
+		return slog.NewJSONHandler(output, opts)
+	}
+	return slog.NewTextHandler(output, opts)
+}
@@ -0,0 +1,236 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	metricsNamespace     = "nues"
+	metricsScrapeTimeout = 5 * time.Second
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Calls served per route and transport.",
+	}, []string{"transport", "route"})
+
+	metricRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of served calls per route and transport.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"transport", "route"})
+
+	metricErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "errors_total",
+		Help:      "Failed calls per route and SysError code.",
+	}, []string{"transport", "route", "code"})
+
+	metricCommandAborts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "command_aborts_total",
+		Help:      "Command transactions aborted per command.",
+	}, []string{"command"})
+
+	metricIdempotencyHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "idempotency_hits_total",
+		Help:      "Commands answered from the command history by callId.",
+	}, []string{"command"})
+
+	metricRpcClientRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_client_requests_total",
+		Help:      "Outgoing RPC calls per target service and result.",
+	}, []string{"service", "route", "result"})
+
+	metricOutbox = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "outbox_deliveries_total",
+		Help:      "Outbox delivery attempts per target service and result.",
+	}, []string{"service", "route", "result"})
+
+	metricDeadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "projection_dead_letters_total",
+		Help:      "Events parked after failing a projection.",
+	}, []string{"projection"})
+
+	metricWatcherRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "watcher_restarts_total",
+		Help:      "Watcher change streams reopened after a failure.",
+	}, []string{"watcher"})
+
+	metricWatcherFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "watcher_callback_failures_total",
+		Help:      "Watcher callbacks failed, the event is retried.",
+	}, []string{"watcher"})
+
+	metricRpcClientDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_client_duration_seconds",
+		Help:      "Latency of outgoing RPC calls per target service.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service", "route"})
+)
+
+var (
+	projectionLagDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "projection", "lag_events"),
+		"Events not yet applied to a projection.",
+		[]string{"projection"}, nil,
+	)
+	watcherLagDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "watcher", "lag_events"),
+		"Events not yet processed by a watcher.",
+		[]string{"watcher"}, nil,
+	)
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricRequests,
+		metricRequestDuration,
+		metricErrors,
+		metricCommandAborts,
+		metricIdempotencyHits,
+		metricRpcClientRequests,
+		metricRpcClientDuration,
+		metricOutbox,
+		metricDeadLetters,
+		metricWatcherRestarts,
+		metricWatcherFailures,
+		lagCollector{},
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// observeCall records a served call, err or the SysError carried by the response counts as a failure
+func observeCall(transport string, route Route, start time.Time, response any, err error) {
+	metricRequests.WithLabelValues(transport, route.Name).Inc()
+	metricRequestDuration.WithLabelValues(transport, route.Name).Observe(time.Since(start).Seconds())
+
+	if err == nil {
+		switch res := response.(type) {
+		case *CommandRoot:
+			err = res.Error
+		case *QueryRoot:
+			err = res.Error
+		}
+	}
+	if err != nil {
+		metricErrors.WithLabelValues(transport, route.Name, errorCode(err)).Inc()
+	}
+}
+
+func observeRpcClient(service, route string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metricRpcClientRequests.WithLabelValues(service, route, result).Inc()
+	metricRpcClientDuration.WithLabelValues(service, route).Observe(time.Since(start).Seconds())
+}
+
+func errorCode(err error) string {
+	var sysErr SysErrorData
+	if errors.As(err, &sysErr) {
+		return strconv.Itoa(sysErr.Code)
+	}
+	return "unknown"
+}
+
+// lagCollector computes projection and watcher lag from the database at scrape time
+type lagCollector struct{}
+
+func (lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- projectionLagDesc
+	ch <- watcherLagDesc
+}
+
+func (lagCollector) Collect(ch chan<- prometheus.Metric) {
+	if DB == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metricsScrapeTimeout)
+	defer cancel()
+
+	projRegistry.Range(func(key, value any) bool {
+		name := key.(string)
+		lag, err := projectionLag(ctx, value.(Projection))
+		if err != nil {
+			slog.Error("projection lag failed", "proj", name, "err", err)
+			return true
+		}
+		ch <- prometheus.MustNewConstMetric(projectionLagDesc, prometheus.GaugeValue, float64(lag), name)
+		return true
+	})
+
+	cur, err := DB.GetCollection(nues.colWatchers).Find(ctx, bson.M{"sequence": bson.M{"$exists": true}})
+	if err != nil {
+		slog.Error("watcher lag failed", "err", err)
+		return
+	}
+	var watchers []struct {
+		Id       string   `bson:"_id"`
+		Event    string   `bson:"event"`
+		Events   []string `bson:"events"`
+		Sequence int64    `bson:"sequence"`
+	}
+	if err := cur.All(ctx, &watchers); err != nil {
+		slog.Error("watcher lag failed", "err", err)
+		return
+	}
+	for _, w := range watchers {
+		var event any = w.Event
+		if len(w.Events) > 0 {
+			event = bson.M{"$in": w.Events}
+		} else if w.Event == "" {
+			// watchers created before they had their own id are keyed by event name
+			event = w.Id
+		}
+		lag, err := DB.Events().CountDocuments(ctx, bson.M{"name": event, "sequence": bson.M{"$gt": w.Sequence}})
+		if err != nil {
+			slog.Error("watcher lag failed", "watcher", w.Id, "err", err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(watcherLagDesc, prometheus.GaugeValue, float64(lag), w.Id)
+	}
+}
+
+func projectionLag(ctx context.Context, p Projection) (int64, error) {
+	proj := &ProjectionRoot{}
+	if store := projectionStore(p); store != nil {
+		seq, err := store.Sequence(ctx, p.Name())
+		if err != nil {
+			return 0, err
+		}
+		proj.Sequence = seq
+	} else if err := DB.Projections().FindOne(ctx, bson.M{"_id": p.Name()}).Decode(proj); err != nil {
+		return 0, err
+	}
+	query := append(buildStreamQuery(p.Steams()), bson.E{Key: "sequence", Value: bson.M{"$gt": proj.Sequence}})
+	return DB.Events().CountDocuments(ctx, query)
+}
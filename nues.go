@@ -3,14 +3,11 @@ package nues
 import (
 	"context"
 	"log/slog"
+	"maps"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
-
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Server interface {
@@ -28,9 +25,51 @@ type Nues struct {
 	ApiPort     string
 	RpcPort     string
 	Routes      Routes
+	// OpsPort serves /healthz, /readyz and the Prometheus /metrics apart from the API, defaults to defaultOpsPort.
+	// Keep it off the public network.
+	OpsPort string
+	// RequestTimeout is the default deadline of an API or RPC call
+	RequestTimeout time.Duration
+	// TraceExporter selects where spans go: TraceExporterOtlp, TraceExporterStdout or none
+	TraceExporter string
+	// TraceEndpoint is the OTLP/HTTP collector host:port
+	TraceEndpoint string
+	// Logger replaces the logger built from Log
+	Logger *slog.Logger
+	Log    LogConfig
+	// IdempotencyTTL is how long a callId result is kept, defaults to 10 minutes
+	IdempotencyTTL time.Duration
+	// RpcTimeout bounds outgoing RPC calls without a deadline, defaults to 10 seconds
+	RpcTimeout time.Duration
+	// RpcRetries is how many times an RPC call carrying a callId is retried, defaults to 3
+	RpcRetries int
+	// ServiceTTL is how long this instance stays discoverable without heartbeat, defaults to 30 seconds
+	ServiceTTL time.Duration
+	// LoadBalancing picks the instance of an RPC call: BalanceRoundRobin (default) or BalanceLeastPending
+	LoadBalancing string
+	// ProjectionBatchSize is how many events a projection applies per checkpoint, defaults to 500
+	ProjectionBatchSize int
+	// ProjectionRetries is how many times an event failing a projection is retried alone, defaults to 3
+	ProjectionRetries int
+	// PoisonEvents is what happens to an event still failing after the retries: PoisonPark (default) or PoisonBlock
+	PoisonEvents string
+	// Projections are kept up to date in the background, see AsyncProjection, or registered, see RegisterProjection
+	Projections []ProjectionRunner
+	// Sagas are started with the service, see NewSaga
+	Sagas []SagaDefinition
+	// OutboxMaxAttempts is how many times an outbox message is sent before it is marked failed, defaults to 20
+	OutboxMaxAttempts int
+	// ReadWaitTimeout bounds how long a read waits for an async projection to reach the asked sequence, defaults to 5 seconds
+	ReadWaitTimeout time.Duration
+	// MaxProjectionLag fails readiness when a projection is more events behind, 0 disables the check
+	MaxProjectionLag int64
+	// AllowedOrigins are the browser origins, like https://app.example.com, allowed to subscribe to queries
+	// besides the API host itself
+	AllowedOrigins []string
 
 	dbPrefix       string
 	adminToken     string
+	serviceToken   string
 	reset          bool
 	colCommands    string
 	colIdentity    string
@@ -38,7 +77,12 @@ type Nues struct {
 	colEvents      string
 	colWatchers    string
 	colProjections string
-	services       []NuesService
+	colOutbox      string
+	colSagas       string
+	colJobs        string
+	colDeadLetters string
+	// context is cancelled on shutdown, it outlives the requests starting background work
+	context context.Context
 }
 
 var nues Nues
@@ -54,35 +98,28 @@ func RunServer(_config Nues) error {
 	MustNotEmpty(_config.Routes, NewError(-1, "Routes is required"))
 
 	nues = _config
-
-	logL := slog.LevelWarn
-	if nues.Debug {
-		slog.Info("setting log level to debug")
-		logL = slog.LevelDebug
+	if nues.OpsPort == "" {
+		nues.OpsPort = defaultOpsPort
 	}
-
-	l := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level:     logL,
-		AddSource: true,
-	}))
-
-	slog.SetDefault(l) // configures log package to print with LevelInfo
-
-	if !slog.Default().Enabled(context.TODO(), logL) {
-		panic("error setting logger")
-	}
-	slog.LogAttrs(context.TODO(), logL, nues.ServiceId)
+	// service routes win over the built-in admin routes
+	nues.Routes = schedulerRoutes()
+	maps.Copy(nues.Routes, projectionRoutes())
+	maps.Copy(nues.Routes, deadLetterRoutes())
+	maps.Copy(nues.Routes, _config.Routes)
+
+	initLogger()
+	slog.Info("starting service", "service_id", nues.ServiceId)
 	run()
 	return nil
 }
 
 func registerCustomValidators() {
 	validate.RegisterValidation("phone_dz", phoneValidator)
-	validate.RegisterValidation("identity", identityValidator)
+	validate.RegisterValidationCtx("identity", identityValidator)
 }
 
 func initConfig() {
-	config := GetConfig[ConfigNues](false)
+	config := GetConfig[ConfigNues](context.TODO(), false)
 	if config == nil {
 		// init default config
 		config = &ConfigNues{
@@ -95,6 +132,10 @@ func initConfig() {
 			ColSessions:    "sessions",
 			ColIdentity:    "identities",
 			ColProjections: "projections",
+			ColOutbox:      "outbox",
+			ColSagas:       "sagas",
+			ColJobs:        "jobs",
+			ColDeadLetters: "dead_letters",
 			DbPrefix:       "sb",
 		}
 		_, err := DB.Collection("__config").InsertOne(context.TODO(), config)
@@ -111,62 +152,62 @@ func initConfig() {
 	nues.colProjections = config.ColProjections
 	nues.colSessions = config.ColSessions
 	nues.colWatchers = config.ColWatchers
+	nues.colOutbox = config.ColOutbox
+	nues.colSagas = config.ColSagas
+	nues.colJobs = config.ColJobs
+	nues.colDeadLetters = config.ColDeadLetters
+	// configs created before these collections existed
+	if nues.colOutbox == "" {
+		nues.colOutbox = "outbox"
+	}
+	if nues.colSagas == "" {
+		nues.colSagas = "sagas"
+	}
+	if nues.colJobs == "" {
+		nues.colJobs = "jobs"
+	}
+	if nues.colDeadLetters == "" {
+		nues.colDeadLetters = "dead_letters"
+	}
 	nues.dbPrefix = config.DbPrefix
 
-	slog.Debug("config loaded successfully", config)
-	insertSelfService()
-	loadServices()
-
-}
-func insertSelfService() {
-	selfService := NuesService{
-		Id:   nues.ServiceId,
-		Name: nues.ServiceName,
-		Ip:   nues.IP,
-		Port: nues.RpcPort,
-	}
-	_, err := DB.Collection("__services").UpdateOne(context.Background(), bson.M{"_id": selfService.Id}, bson.M{"$set": selfService}, options.Update().SetUpsert(true))
-	if err != nil {
-		panic(err)
-	}
-	slog.Debug("self service injected successfully")
-}
-func loadServices() {
-	go func() {
-		for {
-			var services []NuesService
-			cur, err := DB.Collection("__services").Find(context.TODO(), bson.M{})
-			if err != nil {
-				panic(err)
-			}
-			err = cur.All(context.TODO(), &services)
-			if err != nil && err != mongo.ErrNoDocuments {
-				panic(err)
-			}
-			nues.services = services
-			slog.Debug("services loaded successfully", "services", services)
-			time.Sleep(time.Duration(time.Second * 60 * 2))
-		}
-	}()
+	slog.Debug("config loaded successfully", "config", config)
 }
 
 func run() {
 	initNuesDb()
 	initConfig()
 	initNuesIndexes()
-	initAuth()
+	initAuth(context.TODO())
 	registerCustomValidators()
-	var rpc Server
-	if nues.RpcPort != "" {
-		initRpc()
-	}
-
 	ctx, cancel := context.WithCancel(context.TODO())
+	nues.context = ctx
+	shutdownTracing, err := initTracing(ctx)
+	if err != nil {
+		panic(err)
+	}
+	registerSelf(ctx)
+	watchServices(ctx)
+	runOutbox(ctx)
+	runScheduler(ctx)
+	for _, proj := range nues.Projections {
+		proj.start(ctx)
+	}
+	rebuildOutdatedProjections(ctx)
+	for _, saga := range nues.Sagas {
+		if err := saga.start(ctx); err != nil {
+			panic(err)
+		}
+	}
+	var rpc Server
 	var api Server = &NuesApi{
 		context: context.TODO(),
 	}
 	go api.Serve(ctx)
 
+	var ops Server = &NuesOps{}
+	go ops.Serve(ctx)
+
 	if nues.RpcPort != "" {
 		rpc = &NuesRpc{
 			Network: "tcp",
@@ -178,14 +219,24 @@ func run() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	slog.Info("shutdown server ...")
+	// stop the heartbeat first so the instance is not registered again
 	cancel()
+	if err := deregisterSelf(context.TODO()); err != nil {
+		slog.Error("error deregistering service", "err", err)
+	}
 	if err := api.Close(); err != nil {
-		slog.Error("error stopping API", err)
+		slog.Error("error stopping API", "err", err)
 	}
 	if rpc != nil {
 		if err := rpc.Close(); err != nil {
-			slog.Error("error stopping RPC", err)
+			slog.Error("error stopping RPC", "err", err)
 		}
 	}
+	if err := ops.Close(); err != nil {
+		slog.Error("error stopping ops server", "err", err)
+	}
+	if err := shutdownTracing(context.TODO()); err != nil {
+		slog.Error("error flushing traces", "err", err)
+	}
 	slog.Info("server exiting")
 }
@@ -0,0 +1,41 @@
+package nues
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// setupTestDB connects the package to a fresh database of the MongoDB replica set in NUES_TEST_MONGO_URI,
+// tests needing MongoDB are skipped without it
+func setupTestDB(t *testing.T, serviceName string, routes Routes) {
+	t.Helper()
+	uri := os.Getenv("NUES_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("NUES_TEST_MONGO_URI not set")
+	}
+	ctx := context.Background()
+	connectTestDB(serviceName+"-"+GenerateId()[:8], serviceName, "nues_test_"+GenerateId()[:12], routes)
+	t.Cleanup(func() {
+		DB.Drop(ctx)
+		DB.Client().Disconnect(ctx)
+		DB = nil
+		nues = Nues{}
+	})
+}
+
+// connectTestDB configures the package as the instance serviceId of serviceName using the database dbName
+func connectTestDB(serviceId, serviceName, dbName string, routes Routes) {
+	nues = Nues{
+		ServiceId:   serviceId,
+		ServiceName: serviceName,
+		DbUri:       os.Getenv("NUES_TEST_MONGO_URI"),
+		DbName:      dbName,
+		IP:          "127.0.0.1",
+		Routes:      routes,
+	}
+	initNuesDb()
+	initConfig()
+	initNuesIndexes()
+	initAuth(context.Background())
+}
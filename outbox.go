@@ -0,0 +1,241 @@
+package nues
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxFailed    = "failed"
+
+	defaultOutboxMaxAttempts = 20
+	outboxWorkers            = 4
+	outboxPollInterval       = time.Second
+	// outboxLease is how long a claimed message is hidden from other dispatchers
+	outboxLease           = time.Minute
+	outboxDeliveryTimeout = 30 * time.Second
+	outboxBackoffBase     = time.Second
+	outboxBackoffMax      = time.Minute
+	outboxDeliveredTTL    = 24 * time.Hour
+)
+
+// OutboxMessage is a call to another service stored with the command that produced it
+type OutboxMessage struct {
+	Id      string `bson:"_id" json:"id"`
+	Service string `bson:"service" json:"service"`
+	Route   string `bson:"route" json:"route"`
+	// CallId is sent with every attempt so the receiving service runs the command once
+	CallId      string            `bson:"call_id" json:"call_id"`
+	Payload     string            `bson:"payload" json:"payload"`
+	Status      string            `bson:"status" json:"status"`
+	Attempts    int               `bson:"attempts" json:"attempts"`
+	NextAttempt time.Time         `bson:"next_attempt" json:"next_attempt"`
+	LastError   string            `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	Date        time.Time         `bson:"date" json:"date"`
+	DeliveredAt *time.Time        `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+	Trace       map[string]string `bson:"trace,omitempty" json:"trace,omitempty"`
+}
+
+// Enqueue stores a call of route on serviceName to be delivered asynchronously and returns its callId.
+// Called with the context given to Command.Handle the message commits or aborts with the command,
+// it is then delivered at least once and deduplicated by the receiver through the callId.
+func Enqueue(ctx context.Context, serviceName, route string, payload any) (string, error) {
+	if serviceName == "" || route == "" {
+		return "", ErrBadCommand
+	}
+	if mongo.SessionFromContext(ctx) == nil {
+		slog.WarnContext(ctx, "outbox message enqueued outside a command transaction", "service", serviceName, "route", route)
+	}
+	payloadB, err := json.Marshal(payload)
+	if err != nil {
+		return "", ErrBadCommand
+	}
+	now := time.Now()
+	msg := OutboxMessage{
+		Id:          GenerateId(),
+		Service:     serviceName,
+		Route:       route,
+		CallId:      GenerateId(),
+		Payload:     string(payloadB),
+		Status:      outboxPending,
+		NextAttempt: now,
+		Date:        now,
+		Trace:       injectTrace(ctx),
+	}
+	if _, err := DB.GetCollection(nues.colOutbox).InsertOne(ctx, msg); err != nil {
+		slog.ErrorContext(ctx, "outbox enqueue failed", "err", err)
+		return "", ErrSystemInternal
+	}
+	return msg.CallId, nil
+}
+
+func outboxMaxAttempts() int {
+	if nues.OutboxMaxAttempts > 0 {
+		return nues.OutboxMaxAttempts
+	}
+	return defaultOutboxMaxAttempts
+}
+
+func initOutboxIndexes(ctx context.Context) error {
+	_, err := DB.GetCollection(nues.colOutbox).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "delivered_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(outboxDeliveredTTL.Seconds())),
+		},
+	})
+	return err
+}
+
+// runOutbox starts the dispatchers delivering due messages until ctx is done,
+// every instance of the service runs them and a claimed message is leased to one of them
+func runOutbox(ctx context.Context) {
+	for i := 0; i < outboxWorkers; i++ {
+		go func() {
+			ticker := time.NewTicker(outboxPollInterval)
+			defer ticker.Stop()
+			for {
+				for ctx.Err() == nil {
+					found, err := dispatchNext(ctx)
+					if err != nil {
+						if ctx.Err() == nil {
+							slog.Error("outbox dispatch failed", "err", err)
+						}
+						break
+					}
+					if !found {
+						break
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+// dispatchNext claims the oldest due message and delivers it, false when nothing is due
+func dispatchNext(ctx context.Context) (bool, error) {
+	now := time.Now()
+	var msg OutboxMessage
+	err := DB.GetCollection(nues.colOutbox).FindOneAndUpdate(ctx,
+		bson.M{"status": outboxPending, "next_attempt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt": now.Add(outboxLease)}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&msg)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	deliverErr := deliver(ctx, msg)
+	if ctx.Err() != nil {
+		// shutting down, the lease expires and another dispatcher sends it again
+		return true, nil
+	}
+	return true, settle(context.WithoutCancel(ctx), msg, deliverErr)
+}
+
+func deliver(ctx context.Context, msg OutboxMessage) (err error) {
+	ctx, cancel := context.WithTimeout(extractTrace(ctx, msg.Trace), outboxDeliveryTimeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "outbox "+msg.Service+"/"+msg.Route, trace.SpanKindProducer,
+		attribute.String("nues.call_id", msg.CallId), attribute.Int("nues.attempt", msg.Attempts))
+	defer func() {
+		endSpan(span, err)
+	}()
+	ctx = WithLogAttrs(ctx, slog.String("outbox_id", msg.Id), slog.String("call_id", msg.CallId))
+
+	if msg.Service == nues.ServiceName {
+		return deliverLocal(ctx, msg)
+	}
+	res, err := NewRpcClient(msg.Service).Call(ctx, msg.Route, msg.CallId, json.RawMessage(msg.Payload))
+	if err != nil {
+		return err
+	}
+	// a command or query answers with its root, a failed one is a failed delivery
+	var root remoteRoot[json.RawMessage]
+	if json.Unmarshal(res.raw, &root) == nil && root.Error != nil {
+		return *root.Error
+	}
+	return nil
+}
+
+// deliverLocal runs a message addressed to this service without going through RPC
+func deliverLocal(ctx context.Context, msg OutboxMessage) error {
+	route, found := nues.Routes[msg.Route]
+	if !found || route.Call == STREAM {
+		return ErrBadCommand
+	}
+	res, err := rpcServe(ctx, route, &NuesRpcArgs{
+		CommandName: msg.Route,
+		Payload:     json.RawMessage(msg.Payload),
+		CallId:      msg.CallId,
+	})
+	if err != nil {
+		return err
+	}
+	switch root := res.(type) {
+	case *CommandRoot:
+		return root.Error
+	case *QueryRoot:
+		return root.Error
+	}
+	return nil
+}
+
+// settle records the delivery result, failures are retried with backoff unless they are final
+func settle(ctx context.Context, msg OutboxMessage, deliverErr error) error {
+	now := time.Now()
+	var update bson.M
+	switch {
+	case deliverErr == nil:
+		update = bson.M{"$set": bson.M{"status": outboxDelivered, "delivered_at": now}, "$unset": bson.M{"last_error": ""}}
+		metricOutbox.WithLabelValues(msg.Service, msg.Route, outboxDelivered).Inc()
+	case isOutboxRetryable(deliverErr) && msg.Attempts < outboxMaxAttempts():
+		slog.WarnContext(ctx, "outbox delivery failed, retrying", "outbox_id", msg.Id, "attempt", msg.Attempts, "err", deliverErr)
+		update = bson.M{"$set": bson.M{"next_attempt": now.Add(outboxBackoff(msg.Attempts)), "last_error": deliverErr.Error()}}
+		metricOutbox.WithLabelValues(msg.Service, msg.Route, "retry").Inc()
+	default:
+		slog.ErrorContext(ctx, "outbox delivery failed", "outbox_id", msg.Id, "attempt", msg.Attempts, "err", deliverErr)
+		update = bson.M{"$set": bson.M{"status": outboxFailed, "last_error": deliverErr.Error()}}
+		metricOutbox.WithLabelValues(msg.Service, msg.Route, outboxFailed).Inc()
+	}
+	_, err := DB.GetCollection(nues.colOutbox).UpdateOne(ctx, bson.M{"_id": msg.Id}, update)
+	return err
+}
+
+// isOutboxRetryable extends isRetryable to a target with no live or healthy instance, it may come back later,
+// and to timed out deliveries which the receiver dedupes if they went through
+func isOutboxRetryable(err error) bool {
+	if errors.Is(err, ErrServiceNotFound) || errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return isRetryable(err)
+}
+
+// outboxBackoff is exponential in the attempts with jitter, capped to outboxBackoffMax
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxBackoffBase << (attempts - 1)
+	if delay > outboxBackoffMax || delay <= 0 {
+		delay = outboxBackoffMax
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -2,6 +2,7 @@ package nues
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"reflect"
 	"sync"
@@ -11,14 +12,79 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var projMutex map[string]*sync.Mutex = make(map[string]*sync.Mutex)
+// projMutex holds one *sync.Mutex per projection name, catch-up of a projection runs under it
+var projMutex sync.Map
+
+func projectionLock(name string) *sync.Mutex {
+	m, _ := projMutex.LoadOrStore(name, &sync.Mutex{})
+	return m.(*sync.Mutex)
+}
+
+// projRegistry holds every Projection known to this process by name
+var projRegistry sync.Map
+
+func registerProjection(p Projection) {
+	projRegistry.Store(p.Name(), p)
+}
+
+// projActive maps a projection name to the collection serving it, DB.GetCollection resolves projection
+// names through it so projection code keeps using its Name(). projRebuilds maps it to the shadow
+// collection a rebuild of this process writes to, only its writer resolves to it, see DB.ProjectionCollection.
+var (
+	projActive   sync.Map
+	projRebuilds sync.Map
+)
+
+func projectionCollectionName(name string) string {
+	if active, found := projActive.Load(name); found {
+		return active.(string)
+	}
+	return name
+}
+
+// projectionWriterKey holds in a context the collection the projection name is written to
+type projectionWriterKey struct{ name string }
+
+func withProjectionWriter(ctx context.Context, name, collection string) context.Context {
+	return context.WithValue(ctx, projectionWriterKey{name}, collection)
+}
+
+// projectionWriterName is the collection the projection name is written to with ctx
+func projectionWriterName(ctx context.Context, name string) string {
+	if collection, ok := ctx.Value(projectionWriterKey{name}).(string); ok {
+		return collection
+	}
+	return projectionCollectionName(name)
+}
 
 type ProjectionRoot struct {
-	Id       string    `bson:"_id"`
-	Sequence int64     `bson:"sequence"`
-	Modified time.Time `bson:"modified"`
+	Id       string    `bson:"_id" json:"id"`
+	Sequence int64     `bson:"sequence" json:"sequence"`
+	Modified time.Time `bson:"modified" json:"modified"`
+	// Collection is the collection serving the projection, a rebuild swaps it
+	Collection string `bson:"collection" json:"collection"`
+	// Version is the ProjectionVersion the collection was built with
+	Version int `bson:"version" json:"version"`
+	// Degraded is set while events the projection failed on are parked, see DeadLetter
+	Degraded bool `bson:"degraded" json:"degraded"`
+	// Target is the sequence the running catch-up goes to
+	Target int64 `bson:"target" json:"target"`
+	// Runner is the instance keeping an async projection up to date until LeaseUntil
+	Runner     string    `bson:"runner,omitempty" json:"runner,omitempty"`
+	LeaseUntil time.Time `bson:"lease_until,omitempty" json:"lease_until,omitempty"`
+	// Rebuild is the replay into a shadow collection in progress or the last one failed
+	Rebuild *ProjectionRebuild `bson:"rebuild,omitempty" json:"rebuild,omitempty"`
+	// Retired are the collections swapped out by rebuilds, kept a while for the instances still reading them
+	Retired []RetiredCollection `bson:"retired,omitempty" json:"retired,omitempty"`
+}
+
+type RetiredCollection struct {
+	Collection string    `bson:"collection" json:"collection"`
+	DropAfter  time.Time `bson:"drop_after" json:"drop_after"`
 }
 
 type Projection interface {
@@ -28,16 +94,40 @@ type Projection interface {
 	CreateIndexes() error
 }
 
-func GetOne[T Projection](filter bson.M) (*T, error) {
+// ProjectionContext is implemented by projections writing with the given context,
+// their writes then commit in the same transaction as the sequence checkpoint. They write
+// through DB.ProjectionCollection, which is how a rebuild sends their writes to its shadow collection.
+type ProjectionContext interface {
+	UpdateCtx(ctx context.Context, events []Event) (int64, error)
+}
+
+// ProjectionVersion is implemented by projections declaring the version of their Update logic,
+// bumping it rebuilds the projection in the background. Projections without it are version 0.
+// A ProjectionContext is rebuilt in a shadow collection, the others are reset in place and read
+// partly built until they caught up.
+type ProjectionVersion interface {
+	Version() int
+}
+
+func projectionVersion(p Projection) int {
+	if pv, ok := p.(ProjectionVersion); ok {
+		return pv.Version()
+	}
+	return 0
+}
+
+const defaultProjectionBatchSize = 500
+
+func GetOne[T Projection](ctx context.Context, filter bson.M) (*T, error) {
 
-	return GetProjectionFirst[T](mongo.Pipeline{
+	return GetProjectionFirst[T](ctx, mongo.Pipeline{
 		bson.D{{"$match", filter}},
 	})
 }
 
-func GetProjectionFirst[T Projection](pipeline mongo.Pipeline) (*T, error) {
+func GetProjectionFirst[T Projection](ctx context.Context, pipeline mongo.Pipeline) (*T, error) {
 	pipeline = append(pipeline, bson.D{{"$limit", 1}})
-	res, err := GetProjection[T](pipeline)
+	res, err := GetProjection[T](ctx, pipeline)
 	if err != nil {
 		return nil, err
 	}
@@ -46,39 +136,39 @@ func GetProjectionFirst[T Projection](pipeline mongo.Pipeline) (*T, error) {
 	}
 	return nil, nil
 }
-func UpdateProjection[T Projection](id string, valuesMap interface{}, upsert bool) error {
+func UpdateProjection[T Projection](ctx context.Context, id string, valuesMap interface{}, upsert bool) error {
 
 	if err := AssertNotEmpty(id, ErrProjectionFailed); err != nil {
-		slog.Error("project update failed due to missing id")
+		slog.ErrorContext(ctx, "project update failed due to missing id")
 		return err
 	}
 
 	var err error
 	tt := reflect.TypeOf(valuesMap)
 	if tt == reflect.TypeOf(reflect.Struct) {
-		err = validate.Struct(valuesMap)
+		err = validate.StructCtx(ctx, valuesMap)
 	}
 
 	if err != nil {
 		for _, err := range err.(validator.ValidationErrors) {
-			slog.Error(err.Field(), "tag", err.Tag())
+			slog.ErrorContext(ctx, "projection validation failed", "field", err.Field(), "tag", err.Tag())
 		}
-		slog.Error("saving projection failed", "err", err)
+		slog.ErrorContext(ctx, "saving projection failed", "err", err)
 		return err
 	}
 
 	var p T
-	res, err := DB.GetCollection(p.Name()).UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": valuesMap}, options.Update().SetUpsert(upsert))
+	res, err := DB.GetCollection(p.Name()).UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": valuesMap}, options.Update().SetUpsert(upsert))
 	if err != nil {
-		slog.Error("updating projection failed", err)
+		slog.ErrorContext(ctx, "updating projection failed", "err", err)
 		return err
 	}
 	if !upsert && res.MatchedCount == 0 {
-		slog.Error("updating projection failed, not matching docs", "doc", valuesMap)
+		slog.ErrorContext(ctx, "updating projection failed, not matching docs", "doc", valuesMap)
 		return ErrProjectionFailed
 	}
 	if upsert && (res.UpsertedCount+res.MatchedCount) == 0 {
-		slog.Error("upserting projection failed, not upserted docs", "doc", valuesMap)
+		slog.ErrorContext(ctx, "upserting projection failed, not upserted docs", "doc", valuesMap)
 		return ErrProjectionFailed
 	}
 
@@ -86,116 +176,302 @@ func UpdateProjection[T Projection](id string, valuesMap interface{}, upsert boo
 
 }
 
-func BuildProjection[T Projection]() error {
-	var p T
-
+// loadProjectionRoot returns the ProjectionRoot of p, creating it with an empty collection when missing
+func loadProjectionRoot(ctx context.Context, p Projection) (*ProjectionRoot, error) {
 	proj := &ProjectionRoot{}
-	if err := DB.GetCollection(nues.colProjections).FindOne(context.TODO(), bson.D{{"_id", p.Name()}}).Decode(proj); err != nil {
-		slog.Error("no projection exist, creating new projection", "proj", p.Name(), "error", err)
-		if err == mongo.ErrNoDocuments {
-			// no projection, so save one and remove collection
-			DB.GetCollection(p.Name()).Drop(context.TODO())
-			proj = &ProjectionRoot{
-				Id:       p.Name(),
-				Sequence: 0,
-				Modified: time.Now(),
-			}
-			if err := DB.Upsert(nues.colProjections, "_id", proj.Id, proj); err != nil {
-				slog.Error("upsert new projection failed", err)
-				return err
-			}
-
-			err = p.CreateIndexes()
+	err := DB.GetCollection(nues.colProjections).FindOne(ctx, bson.D{{"_id", p.Name()}}).Decode(proj)
+	if err == nil {
+		if proj.Collection == "" {
+			// roots created before rebuilds existed are served by the collection named after the projection
+			proj.Collection = p.Name()
+			_, err = DB.GetCollection(nues.colProjections).UpdateOne(ctx, bson.M{"_id": p.Name(), "collection": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"collection": proj.Collection}})
 			if err != nil {
-				slog.Error("index creation faild", err)
-				panic(err)
+				return nil, err
 			}
+		}
+		projActive.Store(p.Name(), proj.Collection)
+		return proj, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		slog.ErrorContext(ctx, "projection build failed", "err", err)
+		return nil, err
+	}
+	slog.InfoContext(ctx, "no projection exist, creating new projection", "proj", p.Name())
+	proj = &ProjectionRoot{
+		Id:         p.Name(),
+		Sequence:   0,
+		Modified:   time.Now(),
+		Collection: p.Name(),
+		Version:    projectionVersion(p),
+	}
+	// only the instance inserting the root resets the collection
+	_, err = DB.GetCollection(nues.colProjections).InsertOne(ctx, proj)
+	if mongo.IsDuplicateKeyError(err) {
+		return loadProjectionRoot(ctx, p)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "insert new projection failed", "err", err)
+		return nil, err
+	}
+	projActive.Store(p.Name(), proj.Collection)
+	DB.GetCollection(p.Name()).Drop(ctx)
+	err = p.CreateIndexes()
+	if err != nil {
+		slog.ErrorContext(ctx, "index creation faild", "err", err)
+		return nil, err
+	}
+	return proj, nil
+}
 
-		} else {
-			slog.Error("error", err)
-			return err
+func BuildProjection[T Projection](ctx context.Context) error {
+	var p T
+	return buildProjection(ctx, p)
+}
 
+func buildProjection(ctx context.Context, p Projection) error {
+	if store := projectionStore(p); store != nil {
+		return buildStoredProjection(ctx, p, store)
+	}
+	proj, err := loadProjectionRoot(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	registerProjection(p)
+	if rebuildOutdatedProjection(ctx, p, proj) {
+		// a reset moved it back
+		if proj, err = loadProjectionRoot(ctx, p); err != nil {
+			return err
 		}
 	}
+	_, err = catchUpProjection(ctx, p, proj.Sequence, func(ctx context.Context, from, to, target int64) error {
+		return checkpointProjection(ctx, p.Name(), proj.Collection, from, to, target)
+	})
+	return err
+}
 
-	projSeq := proj.Sequence
+// checkpointFunc records that a projection applied the events from the sequence from up to to
+type checkpointFunc func(ctx context.Context, from, to, target int64) error
+
+// catchUpProjection applies the events after from in batches of ProjectionBatchSize and returns
+// the sequence reached, checkpoint runs after every batch so a crash resumes from the last one
+func catchUpProjection(ctx context.Context, p Projection, from int64, checkpoint checkpointFunc) (int64, error) {
 	streamQuery := buildStreamQuery(p.Steams())
-	lastSeq, err := getLastSeq(streamQuery)
+	target, err := getLastSeq(ctx, streamQuery)
 	if err != nil {
-		slog.Error("error getting last sequence", err)
-		return err
+		slog.ErrorContext(ctx, "error getting last sequence", "err", err)
+		return from, err
 	}
 
-	if lastSeq > projSeq {
-		// we need to update
-		eventsQuery := append(streamQuery, bson.D{{"sequence", bson.D{{"$gt", projSeq}}}}...)
-		cur, err := DB.GetCollection(nues.colEvents).Find(context.TODO(), eventsQuery, options.Find().SetSort(bson.D{{"sequence", 1}}))
-		if err != nil && err != mongo.ErrNoDocuments {
-			slog.Error("error", err)
-			return err
+	seq := from
+	batches := 0
+	for seq < target {
+		eventsQuery := append(bson.D{}, streamQuery...)
+		eventsQuery = append(eventsQuery, bson.E{Key: "sequence", Value: bson.D{{"$gt", seq}, {"$lte", target}}})
+		cur, err := DB.GetCollection(nues.colEvents).Find(ctx, eventsQuery,
+			options.Find().SetSort(bson.D{{"sequence", 1}}).SetLimit(int64(projectionBatchSize())))
+		if err != nil {
+			slog.ErrorContext(ctx, "projection build failed", "err", err)
+			return seq, err
 		}
 		events := []Event{}
-		err = cur.All(context.TODO(), &events)
+		if err = cur.All(ctx, &events); err != nil {
+			slog.ErrorContext(ctx, "projection build failed", "err", err)
+			return seq, err
+		}
+		if len(events) == 0 {
+			break
+		}
+		batchCtx, span := startSpan(ctx, "projection batch "+p.Name(), trace.SpanKindInternal,
+			attribute.String("nues.projection", p.Name()), attribute.Int64("nues.sequence", seq), attribute.Int("nues.events", len(events)))
+		seq, err = applyProjectionBatch(batchCtx, p, seq, target, events, checkpoint)
+		var updateErr projectionUpdateError
+		if errors.As(err, &updateErr) {
+			seq, err = handlePoisonEvent(batchCtx, p, seq, target, events, checkpoint, updateErr)
+		}
+		endSpan(span, err)
 		if err != nil {
-			slog.Error("error", err)
-			return err
+			slog.ErrorContext(ctx, "updating projection failed", "proj", p.Name(), "err", err)
+			return seq, err
+		}
+		batches++
+		if batches > 1 || seq < target {
+			slog.InfoContext(ctx, "projection catch-up", "proj", p.Name(), "sequence", seq, "target", target)
 		}
+	}
+	return seq, nil
+}
+
+// applyProjectionBatch hands events to the projection and moves its sequence. A ProjectionContext
+// writes in the same transaction as the checkpoint, Update writes on its own before it.
+// Either way the events applied before a failing one are kept.
+func applyProjectionBatch(ctx context.Context, p Projection, from, target int64, events []Event, checkpoint checkpointFunc) (int64, error) {
+
+	pc, transactional := p.(ProjectionContext)
+	if !transactional {
 		seq, err := p.Update(events)
-		// update project
-		_, errUpdate := DB.SetValue(nues.colProjections, proj.Id, "sequence", seq)
+		if seq > from {
+			// keep what Update applied even when it failed later in the batch
+			if errCheckpoint := checkpoint(ctx, from, seq, target); errCheckpoint != nil {
+				return from, errCheckpoint
+			}
+		}
 		if err != nil {
-			slog.Error("updating projection failed", "err", err)
-			return err
+			return max(seq, from), projectionUpdateError{err}
+		}
+		if seq <= from {
+			slog.ErrorContext(ctx, "projection update did not advance its sequence", "proj", p.Name(), "sequence", seq)
+			return from, projectionUpdateError{ErrProjectionFailed}
 		}
-		if errUpdate != nil {
-			slog.Error("error", errUpdate)
-			return errUpdate
+		return seq, nil
+	}
+
+	seq, applied, err := applyProjectionTransaction(ctx, p, pc, from, target, events, checkpoint)
+	var updateErr projectionUpdateError
+	if errors.As(err, &updateErr) && applied > from {
+		// the batch was rolled back, apply again the events before the failing one on their own
+		ok := []Event{}
+		for _, ev := range events {
+			if ev.Sequence <= applied {
+				ok = append(ok, ev)
+			}
 		}
-		_, errUpdate = DB.SetValue(nues.colProjections, proj.Id, "modified", time.Now())
-		if errUpdate != nil {
-			slog.Error("error", errUpdate)
-			return errUpdate
+		seq, _, errPartial := applyProjectionTransaction(ctx, p, pc, from, target, ok, checkpoint)
+		if errPartial != nil {
+			return from, errPartial
 		}
+		return seq, err
+	}
+	return seq, err
+}
 
+// applyProjectionTransaction runs UpdateCtx and the checkpoint in one transaction, applied is
+// the sequence UpdateCtx reached even when it failed
+func applyProjectionTransaction(ctx context.Context, p Projection, pc ProjectionContext, from, target int64, events []Event, checkpoint checkpointFunc) (seq, applied int64, err error) {
+	err = projectionTransact(ctx, p, func(ctx context.Context) error {
+		seq, err = pc.UpdateCtx(ctx, events)
+		applied = seq
+		if err != nil {
+			return projectionUpdateError{err}
+		}
+		if seq <= from {
+			slog.ErrorContext(ctx, "projection update did not advance its sequence", "proj", p.Name(), "sequence", seq)
+			return projectionUpdateError{ErrProjectionFailed}
+		}
+		return checkpoint(ctx, from, seq, target)
+	})
+	if err != nil {
+		return from, applied, err
+	}
+	return seq, applied, nil
+}
+
+// checkpointProjection moves the sequence from the value the batch started at, another builder
+// moving it or a rebuild swapping the collection meanwhile fails the checkpoint
+func checkpointProjection(ctx context.Context, name, collection string, from, to, target int64) error {
+	res, err := DB.GetCollection(nues.colProjections).UpdateOne(ctx, bson.M{"_id": name, "sequence": from, "collection": collection},
+		bson.M{"$set": bson.M{"sequence": to, "target": target, "modified": time.Now()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		slog.ErrorContext(ctx, "projection sequence moved during catch-up", "proj", name, "from", from)
+		return ErrProjectionFailed
 	}
 	return nil
 }
 
-func GetProjection[T Projection](pipeline mongo.Pipeline) ([]T, error) {
+// activeProjectionCollection is the collection serving p, read from the root when the process does
+// not build p itself as another instance may have swapped it
+func activeProjectionCollection(ctx context.Context, p Projection) (string, error) {
+	if !isAsyncProjection(p.Name()) && readConsistencyFrom(ctx).mode != ConsistencyEventual {
+		if active, found := projActive.Load(p.Name()); found {
+			return active.(string), nil
+		}
+	}
+	proj := &ProjectionRoot{}
+	err := DB.GetCollection(nues.colProjections).FindOne(ctx, bson.M{"_id": p.Name()},
+		options.FindOne().SetProjection(bson.M{"collection": 1})).Decode(proj)
+	if err == mongo.ErrNoDocuments || (err == nil && proj.Collection == "") {
+		return p.Name(), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	projActive.Store(p.Name(), proj.Collection)
+	return proj.Collection, nil
+}
+
+func projectionBatchSize() int {
+	if nues.ProjectionBatchSize > 0 {
+		return nues.ProjectionBatchSize
+	}
+	return defaultProjectionBatchSize
+}
 
-	var p T
-	var m *sync.Mutex = &sync.Mutex{}
-	if f, s := projMutex[p.Name()]; s {
-		m = f
-	} else {
-		projMutex[p.Name()] = m
+// GetProjection runs pipeline on the projection T. A synchronous projection catches up first,
+// an async one is read as it is unless the context asks for more, see WithConsistency.
+// During a rebuild the collection being replaced keeps serving reads.
+func GetProjection[T Projection](ctx context.Context, pipeline mongo.Pipeline) ([]T, error) {
+
+	result := []T{}
+	if err := readProjection[T](ctx, pipeline, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// syncProjection catches a synchronous projection up or waits for an async one, as the read consistency asks
+func syncProjection(ctx context.Context, p Projection) error {
+	rc := readConsistencyFrom(ctx)
+	if isAsyncProjection(p.Name()) {
+		return waitProjection(ctx, p)
 	}
+	if rc.mode == ConsistencyEventual && rc.minSeq <= 0 {
+		return nil
+	}
+	m := projectionLock(p.Name())
 	m.Lock()
 	defer m.Unlock()
-	err := BuildProjection[T]()
+	return buildProjection(ctx, p)
+}
+
+// readProjection catches T up as the read consistency asks and decodes the documents of pipeline into result
+func readProjection[T Projection](ctx context.Context, pipeline mongo.Pipeline, result any) error {
+
+	var p T
+	if projectionStore(p) != nil {
+		slog.ErrorContext(ctx, "stored projection read as a mongo one", "proj", p.Name())
+		return ErrBadCommand
+	}
+	if err := syncProjection(ctx, p); err != nil {
+		slog.ErrorContext(ctx, "get projection faild", "err", err, "pipline", pipeline)
+		return err
+	}
+	col, err := activeProjectionCollection(ctx, p)
 	if err != nil {
-		slog.Error("get projection faild", "err", err, "pipline", pipeline)
-		return nil, err
+		slog.ErrorContext(ctx, "get projection faild", "err", err, "pipline", pipeline)
+		return err
 	}
 
-	result := []T{}
-	cur, err := DB.GetCollection(p.Name()).Aggregate(context.TODO(), pipeline)
+	cur, err := DB.physicalCollection(col).Aggregate(ctx, pipeline)
 	if err != nil {
-		slog.Error("", err)
+		slog.ErrorContext(ctx, "projection query failed", "err", err)
 		if err == mongo.ErrNoDocuments {
-			return result, nil
+			return nil
 		}
-		return nil, ErrSystemInternal
+		return ErrSystemInternal
 	}
 
-	err = cur.All(context.TODO(), &result)
+	err = cur.All(ctx, result)
 
 	if err != nil {
-		slog.Error("", err)
-		return nil, err
+		slog.ErrorContext(ctx, "projection query failed", "err", err)
+		return err
 	}
 
-	return result, nil
+	return nil
 }
 
 func buildStreamQuery(streams []string) bson.D {
@@ -211,17 +487,20 @@ func buildStreamQuery(streams []string) bson.D {
 	return bson.D{{"$or", ora}}
 }
 
-func getLastSeq(query bson.D) (int64, error) {
+func getLastSeq(ctx context.Context, query bson.D) (int64, error) {
 
 	seq := bson.M{}
-	err := DB.GetCollection(nues.colEvents).FindOne(context.TODO(), query, options.FindOne().SetSort(bson.D{{"sequence", -1}}).SetProjection(bson.D{{"sequence", 1}})).Decode(seq)
+	err := DB.GetCollection(nues.colEvents).FindOne(ctx, query, options.FindOne().SetSort(bson.D{{"sequence", -1}}).SetProjection(bson.D{{"sequence", 1}})).Decode(seq)
 	if err == mongo.ErrNoDocuments {
-		slog.Error("error", err)
+		slog.ErrorContext(ctx, "no event found for streams", "err", err)
 		return 0, nil
 	}
+	if err != nil {
+		return 0, err
+	}
 	s, ok := seq["sequence"].(int64)
 	if !ok {
-		panic("wrong sequence type")
+		return 0, ErrSystemInternal
 	}
-	return int64(s), err
+	return s, nil
 }
@@ -0,0 +1,528 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	RebuildRunning = "running"
+	RebuildFailed  = "failed"
+
+	// rebuildStale is how long a rebuild goes without checkpoint before another instance may take it over
+	rebuildStale = 2 * time.Minute
+	// retiredCollectionGrace is how long a collection swapped out stays, other instances read it until
+	// they reload the projection root
+	retiredCollectionGrace = 10 * time.Minute
+)
+
+// ProjectionRebuild is the replay of every event into a shadow collection, swapped in once caught up
+type ProjectionRebuild struct {
+	Collection string    `bson:"collection" json:"collection"`
+	Version    int       `bson:"version" json:"version"`
+	Runner     string    `bson:"runner" json:"runner"`
+	Status     string    `bson:"status" json:"status"`
+	Sequence   int64     `bson:"sequence" json:"sequence"`
+	Target     int64     `bson:"target" json:"target"`
+	Error      string    `bson:"error,omitempty" json:"error,omitempty"`
+	Started    time.Time `bson:"started" json:"started"`
+	Modified   time.Time `bson:"modified" json:"modified"`
+}
+
+func (r *ProjectionRebuild) running() bool {
+	return r != nil && r.Status == RebuildRunning && time.Since(r.Modified) < rebuildStale
+}
+
+// serviceContext outlives the request starting background work and is not bound to its transaction
+func serviceContext() context.Context {
+	if nues.context != nil {
+		return nues.context
+	}
+	return context.Background()
+}
+
+func registeredProjection(name string) (Projection, error) {
+	p, found := projRegistry.Load(name)
+	if !found {
+		return nil, ErrProjectionUnknown
+	}
+	return p.(Projection), nil
+}
+
+// ListProjections returns the root of every projection with the progress of their rebuilds
+func ListProjections(ctx context.Context) ([]ProjectionRoot, error) {
+	cur, err := DB.GetCollection(nues.colProjections).Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	roots := []ProjectionRoot{}
+	err = cur.All(ctx, &roots)
+	return roots, err
+}
+
+// RebuildProjection replays every event of the projection name into a new collection in the background,
+// the current collection keeps serving reads until the new one caught up and is swapped in.
+// It does not join the transaction of ctx, the rebuild starts even if the calling command aborts.
+func RebuildProjection(ctx context.Context, name string) error {
+	p, err := registeredProjection(name)
+	if err != nil {
+		return err
+	}
+	bg := serviceContext()
+	root, err := claimRebuild(bg, p)
+	if err != nil {
+		return err
+	}
+	go runRebuild(bg, p, root)
+	return nil
+}
+
+// RebuildProjections rebuilds every registered projection one after the other in the background
+// and returns their names
+func RebuildProjections(ctx context.Context) []string {
+	names := []string{}
+	projRegistry.Range(func(key, value any) bool {
+		if projectionStore(value.(Projection)) == nil {
+			names = append(names, key.(string))
+		}
+		return true
+	})
+	sort.Strings(names)
+	bg := serviceContext()
+	go func() {
+		for _, name := range names {
+			if bg.Err() != nil {
+				return
+			}
+			p, _ := registeredProjection(name)
+			root, err := claimRebuild(bg, p)
+			if err != nil {
+				slog.Error("projection rebuild not started", "proj", name, "err", err)
+				continue
+			}
+			runRebuild(bg, p, root)
+		}
+	}()
+	return names
+}
+
+// claimRebuild records a new rebuild on the root, unless one is running. The root returned
+// holds the collection to swap out and the rebuild claimed.
+func claimRebuild(ctx context.Context, p Projection) (*ProjectionRoot, error) {
+	if projectionStore(p) != nil {
+		// no shadow collection for stored projections, they are reset
+		return nil, ErrBadCommand
+	}
+	if _, ok := p.(ProjectionContext); !ok {
+		// Update writes without context, it can't be sent to the shadow collection
+		return nil, ErrBadCommand
+	}
+	if _, err := loadProjectionRoot(ctx, p); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rebuild := &ProjectionRebuild{
+		Collection: p.Name() + "_" + GenerateId()[:8],
+		Version:    projectionVersion(p),
+		Runner:     nues.ServiceId,
+		Status:     RebuildRunning,
+		Started:    now,
+		Modified:   now,
+	}
+	previous := &ProjectionRoot{}
+	err := DB.GetCollection(nues.colProjections).FindOneAndUpdate(ctx,
+		bson.M{"_id": p.Name(), "$or": bson.A{
+			bson.M{"rebuild": bson.M{"$exists": false}},
+			bson.M{"rebuild.status": bson.M{"$ne": RebuildRunning}},
+			bson.M{"rebuild.modified": bson.M{"$lt": now.Add(-rebuildStale)}},
+		}},
+		bson.M{"$set": bson.M{"rebuild": rebuild}},
+	).Decode(previous)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrRebuildRunning
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "projection rebuild claim failed", "proj", p.Name(), "err", err)
+		return nil, ErrSystemInternal
+	}
+	if previous.Rebuild != nil && previous.Rebuild.Collection != previous.Collection {
+		// left by a failed or abandoned rebuild
+		DB.physicalCollection(previous.Rebuild.Collection).Drop(ctx)
+	}
+	previous.Rebuild = rebuild
+	return previous, nil
+}
+
+// runRebuild fills the shadow collection of root.Rebuild and swaps it in. Only the rebuild writes to
+// the shadow collection, see DB.ProjectionCollection, the collection being replaced keeps being
+// updated and serving reads meanwhile.
+func runRebuild(ctx context.Context, p Projection, root *ProjectionRoot) {
+	name, shadow := p.Name(), root.Rebuild.Collection
+	projRebuilds.Store(name, shadow)
+	defer projRebuilds.Delete(name)
+
+	ctx, span := startSpan(ctx, "projection rebuild "+name, trace.SpanKindInternal,
+		attribute.String("nues.projection", name), attribute.String("nues.collection", shadow))
+	slog.Info("projection rebuild started", "proj", name, "collection", shadow)
+	seq, err := fillShadowCollection(withProjectionWriter(ctx, name, shadow), p, root.Collection, shadow)
+	if err == nil {
+		err = swapProjectionCollection(ctx, name, root.Collection, root.Rebuild, seq)
+	}
+	if err == nil {
+		// indexes the new version declares, the collection now serves the projection
+		err = p.CreateIndexes()
+	}
+	if err != nil {
+		slog.Error("projection rebuild failed", "proj", name, "err", err)
+		failRebuild(context.WithoutCancel(ctx), name, shadow, err)
+		endSpan(span, err)
+		return
+	}
+	endSpan(span, nil)
+	slog.Info("projection rebuild done", "proj", name, "collection", shadow, "sequence", seq)
+}
+
+func fillShadowCollection(ctx context.Context, p Projection, active, shadow string) (int64, error) {
+	if err := DB.physicalCollection(shadow).Drop(ctx); err != nil {
+		return 0, err
+	}
+	if err := copyIndexes(ctx, active, shadow); err != nil {
+		return 0, err
+	}
+	return catchUpProjection(ctx, p, 0, func(ctx context.Context, from, to, target int64) error {
+		res, err := DB.GetCollection(nues.colProjections).UpdateOne(ctx,
+			bson.M{"_id": p.Name(), "rebuild.collection": shadow, "rebuild.sequence": from},
+			bson.M{"$set": bson.M{"rebuild.sequence": to, "rebuild.target": target, "rebuild.modified": time.Now()}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			slog.ErrorContext(ctx, "projection rebuild taken over", "proj", p.Name(), "collection", shadow)
+			return ErrProjectionFailed
+		}
+		return nil
+	})
+}
+
+// copyIndexes creates on the collection to the indexes of the collection from, CreateIndexes
+// only knows the collection serving the projection
+func copyIndexes(ctx context.Context, from, to string) error {
+	cur, err := DB.physicalCollection(from).Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	specs := []bson.M{}
+	if err := cur.All(ctx, &specs); err != nil {
+		return err
+	}
+	indexes := bson.A{}
+	for _, spec := range specs {
+		if spec["name"] == "_id_" {
+			continue
+		}
+		delete(spec, "v")
+		delete(spec, "ns")
+		indexes = append(indexes, spec)
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	return DB.RunCommand(ctx, bson.D{{Key: "createIndexes", Value: DB.physicalCollection(to).Name()}, {Key: "indexes", Value: indexes}}).Err()
+}
+
+// swapProjectionCollection makes the rebuild collection serve name in one update, builders
+// still checkpointing the previous collection fail and reload the root. The previous collection
+// is retired, it is dropped after retiredCollectionGrace.
+func swapProjectionCollection(ctx context.Context, name, previous string, rebuild *ProjectionRebuild, seq int64) error {
+	shadow := rebuild.Collection
+	now := time.Now()
+	res, err := DB.GetCollection(nues.colProjections).UpdateOne(ctx,
+		bson.M{"_id": name, "collection": previous, "rebuild.collection": shadow},
+		bson.M{
+			"$set":   bson.M{"collection": shadow, "version": rebuild.Version, "sequence": seq, "target": seq, "modified": now},
+			"$unset": bson.M{"rebuild": ""},
+			"$push":  bson.M{"retired": RetiredCollection{Collection: previous, DropAfter: now.Add(retiredCollectionGrace)}},
+		})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrProjectionFailed
+	}
+	projActive.Store(name, shadow)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// dropped by the next start, see rebuildOutdatedProjections
+		case <-time.After(retiredCollectionGrace):
+			dropRetiredCollections(ctx, name)
+		}
+	}()
+	return nil
+}
+
+// dropRetiredCollections drops the collections retired from name whose grace period ended
+func dropRetiredCollections(ctx context.Context, name string) {
+	root := &ProjectionRoot{}
+	err := DB.GetCollection(nues.colProjections).FindOne(ctx, bson.M{"_id": name}).Decode(root)
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			slog.ErrorContext(ctx, "loading retired projection collections failed", "proj", name, "err", err)
+		}
+		return
+	}
+	for _, retired := range root.Retired {
+		if retired.DropAfter.After(time.Now()) || retired.Collection == root.Collection {
+			continue
+		}
+		if err := DB.physicalCollection(retired.Collection).Drop(ctx); err != nil {
+			slog.ErrorContext(ctx, "dropping retired projection collection failed", "proj", name, "collection", retired.Collection, "err", err)
+			continue
+		}
+		_, err := DB.GetCollection(nues.colProjections).UpdateOne(ctx, bson.M{"_id": name},
+			bson.M{"$pull": bson.M{"retired": bson.M{"collection": retired.Collection}}})
+		if err != nil {
+			slog.ErrorContext(ctx, "retired projection collection not recorded as dropped", "proj", name, "collection", retired.Collection, "err", err)
+		}
+	}
+}
+
+func failRebuild(ctx context.Context, name, shadow string, cause error) {
+	_, err := DB.GetCollection(nues.colProjections).UpdateOne(ctx, bson.M{"_id": name, "rebuild.collection": shadow},
+		bson.M{"$set": bson.M{"rebuild.status": RebuildFailed, "rebuild.error": cause.Error(), "rebuild.modified": time.Now()}})
+	if err != nil {
+		slog.ErrorContext(ctx, "projection rebuild failure not recorded", "proj", name, "err", err)
+	}
+	if err := DB.physicalCollection(shadow).Drop(ctx); err != nil {
+		slog.ErrorContext(ctx, "dropping projection rebuild collection failed", "proj", name, "err", err)
+	}
+}
+
+// rebuildOutdatedProjection starts a rebuild of p when root was built with another version,
+// true when it did. A rebuild that failed for this version is left to the admin routes.
+// Projections without ProjectionContext are reset instead, the caller holds projectionLock.
+func rebuildOutdatedProjection(ctx context.Context, p Projection, root *ProjectionRoot) bool {
+	version := projectionVersion(p)
+	if root.Version == version || root.Rebuild.running() {
+		return false
+	}
+	if _, ok := p.(ProjectionContext); !ok {
+		return resetOutdatedProjection(ctx, p, root, version)
+	}
+	if root.Rebuild != nil && root.Rebuild.Status == RebuildFailed && root.Rebuild.Version == version {
+		return false
+	}
+	bg := serviceContext()
+	claimed, err := claimRebuild(bg, p)
+	if errors.Is(err, ErrRebuildRunning) {
+		return false
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "projection rebuild not started", "proj", p.Name(), "err", err)
+		return false
+	}
+	slog.InfoContext(ctx, "projection version changed, rebuilding", "proj", p.Name(), "from", root.Version, "to", version)
+	go runRebuild(bg, p, claimed)
+	return true
+}
+
+// rebuildOutdatedProjections checks the version of every registered projection at startup
+func rebuildOutdatedProjections(ctx context.Context) {
+	rebuilt := []string{}
+	projRegistry.Range(func(key, value any) bool {
+		p := value.(Projection)
+		if projectionStore(p) != nil {
+			return true
+		}
+		root, err := loadProjectionRoot(ctx, p)
+		if err != nil {
+			slog.ErrorContext(ctx, "projection version check failed", "proj", p.Name(), "err", err)
+			return true
+		}
+		dropRetiredCollections(ctx, p.Name())
+		m := projectionLock(p.Name())
+		m.Lock()
+		defer m.Unlock()
+		if rebuildOutdatedProjection(ctx, p, root) {
+			rebuilt = append(rebuilt, p.Name())
+		}
+		return true
+	})
+	if len(rebuilt) > 0 {
+		sort.Strings(rebuilt)
+		slog.InfoContext(ctx, "rebuilding projections with a new version", "projections", rebuilt)
+	}
+}
+
+// resetOutdatedProjection resets p in place for its new version, Update writes without context so it
+// can't fill a shadow collection. Reads see it partly built until it caught up again. The version is
+// claimed first, one instance resets it.
+func resetOutdatedProjection(ctx context.Context, p Projection, root *ProjectionRoot, version int) bool {
+	bg := serviceContext()
+	res, err := DB.GetCollection(nues.colProjections).UpdateOne(bg,
+		bson.M{"_id": p.Name(), "collection": root.Collection, "version": bson.M{"$in": bson.A{root.Version, nil}}},
+		bson.M{"$set": bson.M{"version": version}})
+	if err != nil {
+		slog.ErrorContext(ctx, "projection reset not started", "proj", p.Name(), "err", err)
+		return false
+	}
+	if res.MatchedCount == 0 {
+		return false
+	}
+	slog.WarnContext(ctx, "projection version changed, resetting it in place", "proj", p.Name(), "from", root.Version, "to", version)
+	if err := resetProjectionCollection(ctx, p, root, 0); err != nil {
+		slog.ErrorContext(ctx, "projection reset failed, reset it by hand", "proj", p.Name(), "err", err)
+		return false
+	}
+	return true
+}
+
+// ResetProjection moves the projection name back to seq, the events after it are applied again
+// on the documents in place at the next catch-up. Reset to 0 empties the collection first,
+// the only reset of a stored projection.
+// It does not join the transaction of ctx.
+func ResetProjection(ctx context.Context, name string, seq int64) error {
+	if seq < 0 {
+		return ErrBadCommand
+	}
+	p, err := registeredProjection(name)
+	if err != nil {
+		return err
+	}
+	if _, rebuilding := projRebuilds.Load(name); rebuilding {
+		return ErrRebuildRunning
+	}
+	bg := serviceContext()
+	m := projectionLock(name)
+	m.Lock()
+	defer m.Unlock()
+
+	if store := projectionStore(p); store != nil {
+		if seq != 0 {
+			return ErrBadCommand
+		}
+		if err := resetStoredProjection(bg, p, store); err != nil {
+			slog.ErrorContext(ctx, "projection reset failed", "proj", name, "err", err)
+			return ErrSystemInternal
+		}
+		slog.InfoContext(ctx, "projection reset", "proj", name, "sequence", seq)
+		return nil
+	}
+	root, err := loadProjectionRoot(bg, p)
+	if err != nil {
+		return err
+	}
+	if root.Rebuild.running() {
+		return ErrRebuildRunning
+	}
+	return resetProjectionCollection(ctx, p, root, seq)
+}
+
+// resetProjectionCollection moves the collection of root back to seq, the caller holds projectionLock
+func resetProjectionCollection(ctx context.Context, p Projection, root *ProjectionRoot, seq int64) error {
+	bg, name := serviceContext(), p.Name()
+	if seq == 0 {
+		if err := DB.physicalCollection(root.Collection).Drop(bg); err != nil {
+			slog.ErrorContext(ctx, "projection reset failed", "proj", name, "err", err)
+			return ErrSystemInternal
+		}
+		if err := p.CreateIndexes(); err != nil {
+			slog.ErrorContext(ctx, "projection reset failed", "proj", name, "err", err)
+			return ErrSystemInternal
+		}
+	}
+	res, err := DB.GetCollection(nues.colProjections).UpdateOne(bg, bson.M{"_id": name, "collection": root.Collection},
+		bson.M{"$set": bson.M{"sequence": seq, "target": seq, "modified": time.Now()}})
+	if err != nil {
+		slog.ErrorContext(ctx, "projection reset failed", "proj", name, "err", err)
+		return ErrSystemInternal
+	}
+	if res.MatchedCount == 0 {
+		return ErrProjectionFailed
+	}
+	slog.InfoContext(ctx, "projection reset", "proj", name, "sequence", seq)
+	return nil
+}
+
+// QryProjections lists the projections and their rebuilds, served by the admin route nues_projections
+type QryProjections struct{}
+
+func (q *QryProjections) Handle(ctx context.Context) (QueryResponse, error) {
+	roots, err := ListProjections(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "projections list failed", "err", err)
+		return nil, ErrSystemInternal
+	}
+	return QueryResponse{"projections": roots}, nil
+}
+
+// CmdRebuildProjection starts a rebuild, served by the admin route nues_projection_rebuild
+type CmdRebuildProjection struct {
+	Name string `validate:"required" json:"name"`
+}
+
+func (c *CmdRebuildProjection) Handle(ctx context.Context) (CommandResponse, error) {
+	if err := RebuildProjection(ctx, c.Name); err != nil {
+		return nil, err
+	}
+	return map[string]any{"name": c.Name, "status": RebuildRunning}, nil
+}
+
+// CmdRebuildProjections rebuilds every projection, served by the admin route nues_projection_rebuild_all
+type CmdRebuildProjections struct{}
+
+func (c *CmdRebuildProjections) Handle(ctx context.Context) (CommandResponse, error) {
+	return map[string]any{"names": RebuildProjections(ctx)}, nil
+}
+
+// CmdResetProjection resets a projection, served by the admin route nues_projection_reset
+type CmdResetProjection struct {
+	Name     string `validate:"required" json:"name"`
+	Sequence int64  `validate:"min=0" json:"sequence"`
+}
+
+func (c *CmdResetProjection) Handle(ctx context.Context) (CommandResponse, error) {
+	if err := ResetProjection(ctx, c.Name, c.Sequence); err != nil {
+		return nil, err
+	}
+	return map[string]any{"name": c.Name, "sequence": c.Sequence}, nil
+}
+
+// projectionRoutes are the admin routes added to every service
+func projectionRoutes() Routes {
+	return Routes{
+		"nues_projections": {
+			Name:    "nues_projections",
+			Admin:   true,
+			Call:    QUERY,
+			Handler: func() any { return &QryProjections{} },
+		},
+		"nues_projection_rebuild": {
+			Name:    "nues_projection_rebuild",
+			Admin:   true,
+			Call:    COMMAND,
+			Handler: func() any { return &CmdRebuildProjection{} },
+		},
+		"nues_projection_rebuild_all": {
+			Name:    "nues_projection_rebuild_all",
+			Admin:   true,
+			Call:    COMMAND,
+			Handler: func() any { return &CmdRebuildProjections{} },
+		},
+		"nues_projection_reset": {
+			Name:    "nues_projection_reset",
+			Admin:   true,
+			Call:    COMMAND,
+			Handler: func() any { return &CmdResetProjection{} },
+		},
+	}
+}
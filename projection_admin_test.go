@@ -0,0 +1,171 @@
+package nues
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type EvTestTallied struct {
+	Key string `json:"key"`
+}
+
+// testTallyVersion is the version testTally declares
+var testTallyVersion = 1
+
+// testTally counts the events per key, it only has Update
+type testTally struct {
+	Id string `bson:"_id"`
+	N  int    `bson:"n"`
+}
+
+func (testTally) Name() string         { return "test_tallies" }
+func (testTally) Steams() []string     { return []string{"EvTestTallied"} }
+func (testTally) CreateIndexes() error { return nil }
+func (testTally) Version() int         { return testTallyVersion }
+
+func (t testTally) Update(events []Event) (int64, error) {
+	var seq int64
+	for _, ev := range events {
+		data, err := decodeEventData[EvTestTallied](ev.Data)
+		if err != nil {
+			return seq, err
+		}
+		_, err = DB.GetCollection(t.Name()).UpdateOne(context.Background(), bson.M{"_id": data.Key},
+			bson.M{"$inc": bson.M{"n": 1}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return seq, err
+		}
+		seq = ev.Sequence
+	}
+	return seq, nil
+}
+
+// TestProjectionVersionResetsUpdate checks a projection without ProjectionContext is reset in place
+// when its version changes
+func TestProjectionVersionResetsUpdate(t *testing.T) {
+	setupTestDB(t, "tallies", Routes{})
+	t.Cleanup(func() { testTallyVersion = 1 })
+	ctx := context.Background()
+
+	if err := RegisterEvents(ctx, EvTestTallied{Key: "a"}, EvTestTallied{Key: "a"}, EvTestTallied{Key: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	tallies := func() map[string]int {
+		t.Helper()
+		if err := BuildProjection[testTally](ctx); err != nil {
+			t.Fatal(err)
+		}
+		all, err := GetProjection[testTally](ctx, mongo.Pipeline{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]int{}
+		for _, tally := range all {
+			got[tally.Id] = tally.N
+		}
+		return got
+	}
+	if got := tallies(); got["a"] != 2 || got["b"] != 1 {
+		t.Fatalf("tallies %v", got)
+	}
+
+	testTallyVersion = 2
+	// applied again from the start, not on top of the previous documents
+	if got := tallies(); got["a"] != 2 || got["b"] != 1 {
+		t.Fatalf("tallies %v after the version changed", got)
+	}
+	root, err := loadProjectionRoot(ctx, testTally{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Version != 2 || root.Sequence != 3 {
+		t.Fatalf("root %+v", root)
+	}
+}
+
+// testTallyCtx is testTally written through the context, it can be rebuilt in a shadow collection
+type testTallyCtx struct {
+	testTally `bson:",inline"`
+}
+
+func (testTallyCtx) Name() string { return "test_tallies_ctx" }
+func (testTallyCtx) Version() int { return 1 }
+
+func (t testTallyCtx) Update(events []Event) (int64, error) {
+	return t.UpdateCtx(context.Background(), events)
+}
+
+func (t testTallyCtx) UpdateCtx(ctx context.Context, events []Event) (int64, error) {
+	var seq int64
+	for _, ev := range events {
+		data, err := decodeEventData[EvTestTallied](ev.Data)
+		if err != nil {
+			return seq, err
+		}
+		_, err = DB.ProjectionCollection(ctx, t.Name()).UpdateOne(ctx, bson.M{"_id": data.Key},
+			bson.M{"$inc": bson.M{"n": 1}}, options.Update().SetUpsert(true))
+		if err != nil {
+			return seq, err
+		}
+		seq = ev.Sequence
+	}
+	return seq, nil
+}
+
+// TestRebuildRetiresCollection checks the collection a rebuild swaps out is dropped after its grace period
+func TestRebuildRetiresCollection(t *testing.T) {
+	setupTestDB(t, "tallies", Routes{})
+	ctx := context.Background()
+	p := testTallyCtx{}
+
+	if err := RegisterEvents(ctx, EvTestTallied{Key: "a"}, EvTestTallied{Key: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := BuildProjection[testTallyCtx](ctx); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := claimRebuild(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := claimed.Collection
+	runRebuild(ctx, p, claimed)
+
+	exists := func(collection string) bool {
+		t.Helper()
+		names, err := DB.ListCollectionNames(ctx, bson.M{"name": DB.physicalCollection(collection).Name()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(names) == 1
+	}
+	root, err := loadProjectionRoot(ctx, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Collection == previous || len(root.Retired) != 1 || root.Retired[0].Collection != previous {
+		t.Fatalf("root %+v after the rebuild", root)
+	}
+	dropRetiredCollections(ctx, p.Name())
+	if !exists(previous) {
+		t.Fatal("collection dropped during its grace period")
+	}
+
+	_, err = DB.GetCollection(nues.colProjections).UpdateOne(ctx, bson.M{"_id": p.Name()},
+		bson.M{"$set": bson.M{"retired.0.drop_after": time.Now().Add(-time.Second)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropRetiredCollections(ctx, p.Name())
+	if exists(previous) {
+		t.Fatal("retired collection not dropped")
+	}
+	if root, _ := loadProjectionRoot(ctx, p); len(root.Retired) != 0 {
+		t.Fatalf("retired %v", root.Retired)
+	}
+}
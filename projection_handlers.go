@@ -0,0 +1,131 @@
+package nues
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// EventMeta describes the event a handler applies, its data is given decoded
+type EventMeta struct {
+	Id        string
+	Name      string
+	Sequence  int64
+	Timestamp time.Time
+}
+
+// EventHandler applies one event type to a projection, see On
+type EventHandler struct {
+	event string
+	apply func(ctx context.Context, ev Event) error
+}
+
+// On handles the events named after E, like RegisterEvents names them, with their data decoded into E
+func On[E any](fn func(ctx context.Context, ev E, meta EventMeta) error) EventHandler {
+	name := typeName(new(E))
+	if name == "" {
+		panic("unknown event name")
+	}
+	return EventHandler{
+		event: name,
+		apply: func(ctx context.Context, ev Event) error {
+			data, err := decodeEventData[E](ev.Data)
+			if err != nil {
+				return err
+			}
+			return fn(ctx, data, EventMeta{Id: ev.Id, Name: ev.Name, Sequence: ev.Sequence, Timestamp: ev.Timestamp})
+		},
+	}
+}
+
+func decodeEventData[E any](data any) (E, error) {
+	var e E
+	b, err := bson.Marshal(data)
+	if err != nil {
+		return e, err
+	}
+	err = bson.Unmarshal(b, &e)
+	return e, err
+}
+
+// EventProjection gives the projection P its Update and Steams from the handlers P declares,
+// the streams are the events handled and the sequence is the one of the last event applied.
+// P embeds it inline and declares its handlers:
+//
+//	type Sent struct {
+//		nues.EventProjection[Sent] `bson:",inline"`
+//		...
+//	}
+//
+//	func (Sent) Handlers() []nues.EventHandler {
+//		return []nues.EventHandler{
+//			nues.On(func(ctx context.Context, ev EvSent, meta nues.EventMeta) error { ... }),
+//		}
+//	}
+//
+// Handlers write with the given context through DB.ProjectionCollection, their writes commit with
+// the sequence checkpoint.
+type EventProjection[P any] struct{}
+
+type eventHandlers struct {
+	byEvent map[string]EventHandler
+	streams []string
+}
+
+// projHandlers caches the handlers of every EventProjection by type
+var projHandlers sync.Map
+
+func (EventProjection[P]) handlers() *eventHandlers {
+	t := reflect.TypeOf((*P)(nil)).Elem()
+	if cached, found := projHandlers.Load(t); found {
+		return cached.(*eventHandlers)
+	}
+	var p P
+	declared, ok := any(p).(interface{ Handlers() []EventHandler })
+	if !ok {
+		declared, ok = any(&p).(interface{ Handlers() []EventHandler })
+	}
+	if !ok {
+		panic(fmt.Sprintf("projection %s declares no Handlers", t.Name()))
+	}
+	hs := &eventHandlers{byEvent: map[string]EventHandler{}}
+	for _, h := range declared.Handlers() {
+		if _, found := hs.byEvent[h.event]; found {
+			panic(fmt.Sprintf("projection %s handles %s twice", t.Name(), h.event))
+		}
+		hs.byEvent[h.event] = h
+		hs.streams = append(hs.streams, h.event)
+	}
+	sort.Strings(hs.streams)
+	cached, _ := projHandlers.LoadOrStore(t, hs)
+	return cached.(*eventHandlers)
+}
+
+func (e EventProjection[P]) Steams() []string {
+	return e.handlers().streams
+}
+
+func (e EventProjection[P]) Update(events []Event) (int64, error) {
+	return e.UpdateCtx(context.Background(), events)
+}
+
+// UpdateCtx applies the events in order and stops at the first failing one,
+// the sequence returned is the one of the last event applied
+func (e EventProjection[P]) UpdateCtx(ctx context.Context, events []Event) (int64, error) {
+	hs := e.handlers()
+	var seq int64
+	for _, ev := range events {
+		if h, found := hs.byEvent[ev.Name]; found {
+			if err := h.apply(ctx, ev); err != nil {
+				return seq, err
+			}
+		}
+		seq = ev.Sequence
+	}
+	return seq, nil
+}
@@ -0,0 +1,135 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type EvTestDeposited struct {
+	Account string `bson:"account"`
+	Amount  int    `bson:"amount"`
+}
+
+type EvTestWithdrawn struct {
+	Account string `bson:"account"`
+	Amount  int    `bson:"amount"`
+}
+
+var errTestOverdrawn = errors.New("overdrawn")
+
+// testLedger records the events its handlers applied, a withdrawal of more than 100 fails
+type testLedger struct {
+	EventProjection[testLedger] `bson:",inline"`
+}
+
+var testLedgerApplied []string
+
+func (testLedger) Name() string         { return "test_ledger" }
+func (testLedger) CreateIndexes() error { return nil }
+
+func (testLedger) Handlers() []EventHandler {
+	return []EventHandler{
+		On(func(ctx context.Context, ev EvTestWithdrawn, meta EventMeta) error {
+			if ev.Amount > 100 {
+				return errTestOverdrawn
+			}
+			testLedgerApplied = append(testLedgerApplied, fmt.Sprintf("%d %s %s -%d", meta.Sequence, meta.Name, ev.Account, ev.Amount))
+			return nil
+		}),
+		On(func(ctx context.Context, ev EvTestDeposited, meta EventMeta) error {
+			testLedgerApplied = append(testLedgerApplied, fmt.Sprintf("%d %s %s +%d", meta.Sequence, meta.Name, ev.Account, ev.Amount))
+			return nil
+		}),
+	}
+}
+
+type testDoubled struct {
+	EventProjection[testDoubled] `bson:",inline"`
+}
+
+func (testDoubled) Handlers() []EventHandler {
+	apply := func(ctx context.Context, ev EvTestDeposited, meta EventMeta) error { return nil }
+	return []EventHandler{On(apply), On(apply)}
+}
+
+func testLedgerEvent(t *testing.T, seq int64, data any) Event {
+	t.Helper()
+	m, err := ParseM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Event{Id: GenerateId(), Name: typeName(data), Sequence: seq, Data: m}
+}
+
+func applyTestLedger(t *testing.T, events ...Event) (int64, error) {
+	t.Helper()
+	testLedgerApplied = nil
+	return testLedger{}.UpdateCtx(context.Background(), events)
+}
+
+func TestEventProjectionSteams(t *testing.T) {
+	// sorted whatever the order the handlers are declared in
+	want := []string{"EvTestDeposited", "EvTestWithdrawn"}
+	if got := (testLedger{}).Steams(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("streams %v, want %v", got, want)
+	}
+	var _ Projection = testLedger{}
+}
+
+func TestEventProjectionUpdate(t *testing.T) {
+	seq, err := applyTestLedger(t,
+		testLedgerEvent(t, 1, EvTestDeposited{Account: "a1", Amount: 30}),
+		testLedgerEvent(t, 2, EvTestWithdrawn{Account: "a1", Amount: 10}),
+		// events without handler are skipped, the sequence still moves past them
+		testLedgerEvent(t, 3, EvTestOrderNoted{OrderId: "o1"}),
+	)
+	if err != nil || seq != 3 {
+		t.Fatalf("sequence %d, err %v", seq, err)
+	}
+	want := []string{"1 EvTestDeposited a1 +30", "2 EvTestWithdrawn a1 -10"}
+	if !reflect.DeepEqual(testLedgerApplied, want) {
+		t.Fatalf("applied %v, want %v", testLedgerApplied, want)
+	}
+}
+
+func TestEventProjectionUpdateFails(t *testing.T) {
+	// the events after a failing one are not applied, the sequence is the one of the last applied
+	seq, err := applyTestLedger(t,
+		testLedgerEvent(t, 4, EvTestDeposited{Account: "a1", Amount: 30}),
+		testLedgerEvent(t, 5, EvTestOrderNoted{OrderId: "o1"}),
+		testLedgerEvent(t, 6, EvTestWithdrawn{Account: "a1", Amount: 500}),
+		testLedgerEvent(t, 7, EvTestDeposited{Account: "a1", Amount: 1}),
+	)
+	if !errors.Is(err, errTestOverdrawn) || seq != 5 {
+		t.Fatalf("sequence %d, err %v", seq, err)
+	}
+	if want := []string{"4 EvTestDeposited a1 +30"}; !reflect.DeepEqual(testLedgerApplied, want) {
+		t.Fatalf("applied %v, want %v", testLedgerApplied, want)
+	}
+
+	seq, err = applyTestLedger(t, testLedgerEvent(t, 8, EvTestWithdrawn{Account: "a1", Amount: 500}))
+	if !errors.Is(err, errTestOverdrawn) || seq != 0 {
+		t.Fatalf("sequence %d, err %v", seq, err)
+	}
+
+	// data not matching the event type fails like its handler
+	bad := Event{Id: GenerateId(), Name: "EvTestDeposited", Sequence: 9, Data: bson.M{"amount": "thirty"}}
+	seq, err = applyTestLedger(t, testLedgerEvent(t, 8, EvTestDeposited{Account: "a1", Amount: 1}), bad)
+	if err == nil || seq != 8 || len(testLedgerApplied) != 1 {
+		t.Fatalf("sequence %d, err %v, applied %v", seq, err, testLedgerApplied)
+	}
+}
+
+func TestEventProjectionHandledTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("an event handled twice is accepted")
+		}
+	}()
+	testDoubled{}.Steams()
+}
@@ -0,0 +1,160 @@
+package nues
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore keeps a projection of documents D by id in the process, for fast lookups on hot paths.
+// It starts empty so every instance replays the events at start, async ones are kept up to date by
+// every instance. Handlers write with Put and Delete, the writes of a batch apply with its checkpoint.
+type MemoryStore[D any] struct {
+	mu   sync.RWMutex
+	docs map[string]D
+	seq  int64
+}
+
+func NewMemoryStore[D any]() *MemoryStore[D] {
+	return &MemoryStore[D]{docs: map[string]D{}}
+}
+
+type memoryTxKey struct{}
+
+// memoryTx stages the writes of a batch, a deleted id is staged as nil
+type memoryTx[D any] struct {
+	store  *MemoryStore[D]
+	writes map[string]*D
+	seq    *int64
+}
+
+func (m *MemoryStore[D]) tx(ctx context.Context) *memoryTx[D] {
+	tx, ok := ctx.Value(memoryTxKey{}).(*memoryTx[D])
+	if !ok || tx.store != m {
+		return nil
+	}
+	return tx
+}
+
+func (m *MemoryStore[D]) local() bool {
+	return true
+}
+
+// Get returns the document of id, as written so far by the batch of ctx
+func (m *MemoryStore[D]) Get(ctx context.Context, id string) (D, bool) {
+	if tx := m.tx(ctx); tx != nil {
+		if doc, staged := tx.writes[id]; staged {
+			if doc == nil {
+				var zero D
+				return zero, false
+			}
+			return *doc, true
+		}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	doc, found := m.docs[id]
+	return doc, found
+}
+
+// All returns the committed documents by id
+func (m *MemoryStore[D]) All(ctx context.Context) map[string]D {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	docs := make(map[string]D, len(m.docs))
+	for id, doc := range m.docs {
+		docs[id] = doc
+	}
+	return docs
+}
+
+func (m *MemoryStore[D]) Put(ctx context.Context, id string, doc D) {
+	if tx := m.tx(ctx); tx != nil {
+		tx.writes[id] = &doc
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.docs[id] = doc
+}
+
+func (m *MemoryStore[D]) Delete(ctx context.Context, id string) {
+	if tx := m.tx(ctx); tx != nil {
+		tx.writes[id] = nil
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.docs, id)
+}
+
+func (m *MemoryStore[D]) Sequence(ctx context.Context, name string) (int64, error) {
+	if tx := m.tx(ctx); tx != nil && tx.seq != nil {
+		return *tx.seq, nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.seq, nil
+}
+
+func (m *MemoryStore[D]) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	if m.tx(ctx) != nil {
+		return fn(ctx)
+	}
+	tx := &memoryTx[D]{store: m, writes: map[string]*D{}}
+	if err := fn(context.WithValue(ctx, memoryTxKey{}, tx)); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, doc := range tx.writes {
+		if doc == nil {
+			delete(m.docs, id)
+		} else {
+			m.docs[id] = *doc
+		}
+	}
+	if tx.seq != nil {
+		m.seq = *tx.seq
+	}
+	return nil
+}
+
+func (m *MemoryStore[D]) Checkpoint(ctx context.Context, name string, from, to int64) error {
+	if tx := m.tx(ctx); tx != nil {
+		current, _ := m.Sequence(ctx, name)
+		if current != from {
+			return ErrProjectionFailed
+		}
+		tx.seq = &to
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seq != from {
+		return ErrProjectionFailed
+	}
+	m.seq = to
+	return nil
+}
+
+// Reset empties the store and moves it back to 0, with the batch of ctx when there is one
+func (m *MemoryStore[D]) Reset(ctx context.Context, name string) error {
+	if tx := m.tx(ctx); tx != nil {
+		m.mu.RLock()
+		for id := range m.docs {
+			tx.writes[id] = nil
+		}
+		m.mu.RUnlock()
+		for id := range tx.writes {
+			tx.writes[id] = nil
+		}
+		zero := int64(0)
+		tx.seq = &zero
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.docs = map[string]D{}
+	m.seq = 0
+	return nil
+}
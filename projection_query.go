@@ -0,0 +1,376 @@
+package nues
+
+import (
+	"context"
+	"encoding/base64"
+	"log/slog"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 1000
+)
+
+// ProjectionQuery reads the projection T with filters, sort, field selection and paging,
+// it goes through the same catch-up as GetProjection
+type ProjectionQuery[T Projection] struct {
+	conds  bson.A
+	sort   bson.D
+	fields []string
+	limit  int64
+	offset int64
+	cursor string
+	total  bool
+}
+
+// QueryProjection starts a query on the projection T
+func QueryProjection[T Projection]() *ProjectionQuery[T] {
+	return &ProjectionQuery[T]{}
+}
+
+func (q *ProjectionQuery[T]) where(field, op string, value any) *ProjectionQuery[T] {
+	q.conds = append(q.conds, bson.M{field: bson.M{op: value}})
+	return q
+}
+
+func (q *ProjectionQuery[T]) Eq(field string, value any) *ProjectionQuery[T] {
+	return q.where(field, "$eq", value)
+}
+
+func (q *ProjectionQuery[T]) Ne(field string, value any) *ProjectionQuery[T] {
+	return q.where(field, "$ne", value)
+}
+
+func (q *ProjectionQuery[T]) Gt(field string, value any) *ProjectionQuery[T] {
+	return q.where(field, "$gt", value)
+}
+
+func (q *ProjectionQuery[T]) Gte(field string, value any) *ProjectionQuery[T] {
+	return q.where(field, "$gte", value)
+}
+
+func (q *ProjectionQuery[T]) Lt(field string, value any) *ProjectionQuery[T] {
+	return q.where(field, "$lt", value)
+}
+
+func (q *ProjectionQuery[T]) Lte(field string, value any) *ProjectionQuery[T] {
+	return q.where(field, "$lte", value)
+}
+
+// In matches the documents whose field is one of values, values is a slice
+func (q *ProjectionQuery[T]) In(field string, values any) *ProjectionQuery[T] {
+	return q.where(field, "$in", values)
+}
+
+func (q *ProjectionQuery[T]) Exists(field string, exists bool) *ProjectionQuery[T] {
+	return q.where(field, "$exists", exists)
+}
+
+// Match adds a raw filter for what the other conditions do not cover
+func (q *ProjectionQuery[T]) Match(filter bson.M) *ProjectionQuery[T] {
+	q.conds = append(q.conds, filter)
+	return q
+}
+
+// Sort orders by the fields, ascending unless prefixed with "-". Ties are ordered by _id.
+func (q *ProjectionQuery[T]) Sort(fields ...string) *ProjectionQuery[T] {
+	for _, f := range fields {
+		if name, desc := strings.CutPrefix(f, "-"); desc {
+			q.sort = append(q.sort, bson.E{Key: name, Value: -1})
+		} else {
+			q.sort = append(q.sort, bson.E{Key: f, Value: 1})
+		}
+	}
+	return q
+}
+
+// Fields selects the fields returned, the others are left to their zero value. A dotted path
+// selects part of a sub document, it is dropped when its parent is selected too.
+func (q *ProjectionQuery[T]) Fields(fields ...string) *ProjectionQuery[T] {
+	q.fields = append(q.fields, fields...)
+	return q
+}
+
+func (q *ProjectionQuery[T]) Limit(limit int64) *ProjectionQuery[T] {
+	q.limit = limit
+	return q
+}
+
+// Offset skips the first documents, After is cheaper on deep pages
+func (q *ProjectionQuery[T]) Offset(offset int64) *ProjectionQuery[T] {
+	q.offset = offset
+	return q
+}
+
+// After continues from the Next cursor of a page of the same query, Offset is then ignored
+func (q *ProjectionQuery[T]) After(cursor string) *ProjectionQuery[T] {
+	q.cursor = cursor
+	return q
+}
+
+// WithTotal makes Page count every matching document
+func (q *ProjectionQuery[T]) WithTotal() *ProjectionQuery[T] {
+	q.total = true
+	return q
+}
+
+// Paging applies the paging asked by a client
+func (q *ProjectionQuery[T]) Paging(req PageRequest) *ProjectionQuery[T] {
+	q.limit, q.offset, q.cursor = req.Limit, req.Offset, req.Cursor
+	if req.Total {
+		q.total = true
+	}
+	return q
+}
+
+func (q *ProjectionQuery[T]) filter() bson.D {
+	if len(q.conds) == 0 {
+		return bson.D{}
+	}
+	return bson.D{{Key: "$and", Value: q.conds}}
+}
+
+// sortKeys ends with _id so every document has its own place, cursors depend on it
+func (q *ProjectionQuery[T]) sortKeys() bson.D {
+	keys := append(bson.D{}, q.sort...)
+	for _, k := range keys {
+		if k.Key == "_id" {
+			return keys
+		}
+	}
+	return append(keys, bson.E{Key: "_id", Value: 1})
+}
+
+func (q *ProjectionQuery[T]) pipeline(limit int64) (mongo.Pipeline, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: q.filter()}}}
+	keys := q.sortKeys()
+	if q.cursor != "" {
+		after, err := decodeCursor(q.cursor, keys)
+		if err != nil {
+			return nil, err
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: after}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: keys}})
+	if q.cursor == "" && q.offset > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: q.offset}})
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	if len(q.fields) > 0 {
+		paths := append([]string{}, q.fields...)
+		// cursors read the sort keys from the last document
+		for _, k := range keys {
+			paths = append(paths, k.Key)
+		}
+		pipeline = append(pipeline, bson.D{{Key: "$project", Value: projectPaths(paths)}})
+	}
+	return pipeline, nil
+}
+
+// All returns the matching documents, the limit applies when set
+func (q *ProjectionQuery[T]) All(ctx context.Context) ([]T, error) {
+	pipeline, err := q.pipeline(q.limit)
+	if err != nil {
+		return nil, err
+	}
+	return GetProjection[T](ctx, pipeline)
+}
+
+// First returns the first matching document, nil when none
+func (q *ProjectionQuery[T]) First(ctx context.Context) (*T, error) {
+	pipeline, err := q.pipeline(1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := GetProjection[T](ctx, pipeline)
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+	return &res[0], nil
+}
+
+// Count returns how many documents match the filters
+func (q *ProjectionQuery[T]) Count(ctx context.Context) (int64, error) {
+	counts := []struct {
+		N int64 `bson:"n"`
+	}{}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: q.filter()}}, {{Key: "$count", Value: "n"}}}
+	if err := readProjection[T](ctx, pipeline, &counts); err != nil {
+		return 0, err
+	}
+	if len(counts) == 0 {
+		return 0, nil
+	}
+	return counts[0].N, nil
+}
+
+// Page returns one page of documents with a cursor to the next one
+func (q *ProjectionQuery[T]) Page(ctx context.Context) (*Page[T], error) {
+	limit := q.limit
+	if limit <= 0 {
+		limit = defaultPageLimit
+	}
+	limit = min(limit, maxPageLimit)
+	// one more tells whether there is a next page
+	pipeline, err := q.pipeline(limit + 1)
+	if err != nil {
+		return nil, err
+	}
+	raws := []bson.Raw{}
+	if err := readProjection[T](ctx, pipeline, &raws); err != nil {
+		return nil, err
+	}
+
+	page := &Page[T]{Items: []T{}, Info: PageInfo{Limit: limit}}
+	if q.cursor == "" {
+		page.Info.Offset = q.offset
+	}
+	if int64(len(raws)) > limit {
+		raws = raws[:limit]
+		page.Info.HasMore = true
+	}
+	for _, raw := range raws {
+		var item T
+		if err := bson.Unmarshal(raw, &item); err != nil {
+			slog.ErrorContext(ctx, "projection query failed", "err", err)
+			return nil, ErrSystemInternal
+		}
+		page.Items = append(page.Items, item)
+	}
+	if page.Info.HasMore {
+		if page.Info.Next, err = encodeCursor(raws[len(raws)-1], q.sortKeys()); err != nil {
+			return nil, err
+		}
+	}
+	if q.total {
+		total, err := q.Count(ctx)
+		if err != nil {
+			return nil, err
+		}
+		page.Info.Total = &total
+	}
+	return page, nil
+}
+
+// PageRequest is the paging a client asks for, embed it in paged queries
+type PageRequest struct {
+	Limit  int64  `validate:"min=0" json:"limit"`
+	Offset int64  `validate:"min=0" json:"offset"`
+	Cursor string `json:"cursor"`
+	Total  bool   `json:"total"`
+}
+
+type PageInfo struct {
+	Limit  int64 `json:"limit"`
+	Offset int64 `json:"offset"`
+	// Total is set when asked, see WithTotal
+	Total   *int64 `json:"total,omitempty"`
+	Next    string `json:"next,omitempty"`
+	HasMore bool   `json:"has_more"`
+}
+
+type Page[T any] struct {
+	Items []T      `json:"items"`
+	Info  PageInfo `json:"page"`
+}
+
+// Response is the paged shape answered to clients: {"items": [...], "page": {...}}
+func (p *Page[T]) Response() QueryResponse {
+	return QueryResponse{"items": p.Items, "page": p.Info}
+}
+
+type pageCursor struct {
+	Values []bson.RawValue `bson:"v"`
+}
+
+func encodeCursor(last bson.Raw, keys bson.D) (string, error) {
+	c := pageCursor{}
+	for _, k := range keys {
+		v, err := last.LookupErr(strings.Split(k.Key, ".")...)
+		if err != nil {
+			v = bson.RawValue{Type: bsontype.Null, Value: []byte{}}
+		}
+		c.Values = append(c.Values, v)
+	}
+	b, err := bson.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeCursor turns a cursor into the filter of the documents sorted after it:
+// k1 after v1, or k1 = v1 and k2 after v2, and so on. Null and missing values sort first
+func decodeCursor(cursor string, keys bson.D) (bson.D, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrBadCommand
+	}
+	c := pageCursor{}
+	if err := bson.Unmarshal(b, &c); err != nil || len(c.Values) != len(keys) {
+		return nil, ErrBadCommand
+	}
+	or := bson.A{}
+	for i, k := range keys {
+		after, ok := sortedAfter(k, c.Values[i])
+		if !ok {
+			continue
+		}
+		cond := bson.D{}
+		for j := 0; j < i; j++ {
+			// equal to null also matches a missing field
+			cond = append(cond, bson.E{Key: keys[j].Key, Value: c.Values[j]})
+		}
+		or = append(or, append(cond, after))
+	}
+	if len(or) == 0 {
+		return nil, ErrBadCommand
+	}
+	return bson.D{{Key: "$or", Value: or}}, nil
+}
+
+// sortedAfter is the condition on k of the values sorted after v. Mongo compares $gt and $lt within
+// one type, so null is handled apart: every non null value is after it ascending, none descending,
+// and null comes after every value descending. ok is false when nothing comes after v
+func sortedAfter(k bson.E, v bson.RawValue) (bson.E, bool) {
+	descending := k.Value == -1
+	if v.Type == bsontype.Null {
+		if descending {
+			return bson.E{}, false
+		}
+		return bson.E{Key: k.Key, Value: bson.M{"$ne": nil}}, true
+	}
+	if descending {
+		return bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: k.Key, Value: bson.M{"$lt": v}}},
+			bson.D{{Key: k.Key, Value: nil}},
+		}}, true
+	}
+	return bson.E{Key: k.Key, Value: bson.M{"$gt": v}}, true
+}
+
+// projectPaths includes every path once, a path under another one is dropped since mongo rejects
+// a projection of both a and a.b
+func projectPaths(paths []string) bson.D {
+	project := bson.D{}
+	for i, p := range paths {
+		covered := false
+		for j, other := range paths {
+			if (other == p && j < i) || strings.HasPrefix(p, other+".") {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			project = append(project, bson.E{Key: p, Value: 1})
+		}
+	}
+	return project
+}
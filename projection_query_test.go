@@ -0,0 +1,255 @@
+package nues
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type testScore struct {
+	Id     string `bson:"_id"`
+	Player string `bson:"player"`
+	Points int    `bson:"points"`
+	Stats  struct {
+		Wins   int `bson:"wins"`
+		Losses int `bson:"losses"`
+	} `bson:"stats"`
+}
+
+func (testScore) Name() string                         { return "test_scores" }
+func (testScore) Update(events []Event) (int64, error) { return 0, nil }
+func (testScore) Steams() []string                     { return []string{"EvTestScored"} }
+func (testScore) CreateIndexes() error                 { return nil }
+
+// stage returns the stage named op of the pipeline, nil when it has none
+func stage(pipeline mongo.Pipeline, op string) any {
+	for _, s := range pipeline {
+		if s[0].Key == op {
+			return s[0].Value
+		}
+	}
+	return nil
+}
+
+func TestQueryFieldsProjection(t *testing.T) {
+	for _, tc := range []struct {
+		fields []string
+		want   bson.D
+	}{
+		{[]string{"player"}, bson.D{{Key: "player", Value: 1}, {Key: "_id", Value: 1}}},
+		{[]string{"stats.wins", "stats", "stats.losses"}, bson.D{{Key: "stats", Value: 1}, {Key: "_id", Value: 1}}},
+		{[]string{"player", "player", "_id"}, bson.D{{Key: "player", Value: 1}, {Key: "_id", Value: 1}}},
+		// a field sharing a prefix is no child
+		{[]string{"stat", "stats.wins"}, bson.D{{Key: "stat", Value: 1}, {Key: "stats.wins", Value: 1}, {Key: "_id", Value: 1}}},
+	} {
+		pipeline, err := QueryProjection[testScore]().Fields(tc.fields...).pipeline(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stage(pipeline, "$project"); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("fields %v projected as %v, want %v", tc.fields, got, tc.want)
+		}
+	}
+
+	// the sort keys are kept for the cursor, unless their parent is selected
+	pipeline, err := QueryProjection[testScore]().Fields("stats").Sort("-stats.wins").pipeline(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.D{{Key: "stats", Value: 1}, {Key: "_id", Value: 1}}
+	if got := stage(pipeline, "$project"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("projected as %v, want %v", got, want)
+	}
+	pipeline, err = QueryProjection[testScore]().Fields("player").Sort("-points").pipeline(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = bson.D{{Key: "player", Value: 1}, {Key: "points", Value: 1}, {Key: "_id", Value: 1}}
+	if got := stage(pipeline, "$project"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("projected as %v, want %v", got, want)
+	}
+}
+
+// expectFilter compares filters as mongo reads them
+func expectFilter(t *testing.T, filter, want bson.D) {
+	t.Helper()
+	b, err := bson.Marshal(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := bson.D{}
+	if err := bson.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("filter %v, want %v", got, want)
+	}
+}
+
+func TestQueryCursor(t *testing.T) {
+	keys := QueryProjection[testScore]().Sort("-points").sortKeys()
+	last, err := bson.Marshal(bson.D{{Key: "_id", Value: "s3"}, {Key: "player", Value: "ana"}, {Key: "points", Value: 7}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := encodeCursor(last, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := decodeCursor(cursor, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// points below 7 or missing, or 7 and an _id after s3
+	want := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "points", Value: bson.D{{Key: "$lt", Value: int32(7)}}}},
+			bson.D{{Key: "points", Value: nil}},
+		}}},
+		bson.D{{Key: "points", Value: int32(7)}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: "s3"}}}},
+	}}}
+	expectFilter(t, after, want)
+
+	// a missing value sorts first: nothing is below it, every value is above it
+	last, err = bson.Marshal(bson.D{{Key: "_id", Value: "s3"}, {Key: "player", Value: "ana"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sort, want := range map[string]bson.D{
+		"-points": {{Key: "$or", Value: bson.A{
+			bson.D{{Key: "points", Value: nil}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: "s3"}}}},
+		}}},
+		"points": {{Key: "$or", Value: bson.A{
+			bson.D{{Key: "points", Value: bson.D{{Key: "$ne", Value: nil}}}},
+			bson.D{{Key: "points", Value: nil}, {Key: "_id", Value: bson.D{{Key: "$gt", Value: "s3"}}}},
+		}}},
+	} {
+		keys := QueryProjection[testScore]().Sort(sort).sortKeys()
+		missing, err := encodeCursor(last, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := decodeCursor(missing, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectFilter(t, after, want)
+	}
+
+	for _, bad := range []string{"not a cursor!", cursor[:len(cursor)-4]} {
+		if _, err := decodeCursor(bad, keys); err != ErrBadCommand {
+			t.Fatalf("cursor %q: err = %v, want %v", bad, err, ErrBadCommand)
+		}
+	}
+	// a cursor of another sort is rejected
+	if _, err := decodeCursor(cursor, QueryProjection[testScore]().sortKeys()); err != ErrBadCommand {
+		t.Fatalf("err = %v, want %v", err, ErrBadCommand)
+	}
+
+	// the cursor replaces the offset
+	pipeline, err := QueryProjection[testScore]().Sort("-points").Offset(10).After(cursor).pipeline(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stage(pipeline, "$skip") != nil {
+		t.Fatal("offset applied with a cursor")
+	}
+	pipeline, err = QueryProjection[testScore]().Offset(10).pipeline(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stage(pipeline, "$skip") != int64(10) || stage(pipeline, "$limit") != int64(5) {
+		t.Fatalf("pipeline %v", pipeline)
+	}
+}
+
+func TestQueryPages(t *testing.T) {
+	setupTestDB(t, "scores", Routes{})
+	ctx := context.Background()
+	if err := BuildProjection[testScore](ctx); err != nil {
+		t.Fatal(err)
+	}
+	docs := []any{}
+	for i := 0; i < 7; i++ {
+		// pairs of equal points, the _id orders them
+		docs = append(docs, bson.M{"_id": fmt.Sprintf("s%d", i), "player": fmt.Sprintf("p%d", i), "points": i / 2,
+			"stats": bson.M{"wins": i, "losses": 1}})
+	}
+	if _, err := DB.GetCollection(testScore{}.Name()).InsertMany(ctx, docs); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 4 {
+			t.Fatal("paging does not end")
+		}
+		page, err := QueryProjection[testScore]().Sort("-points").Fields("player", "stats.wins").Limit(3).WithTotal().After(cursor).Page(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Info.Total == nil || *page.Info.Total != 7 {
+			t.Fatalf("total %v", page.Info.Total)
+		}
+		for _, item := range page.Items {
+			if item.Player == "" || item.Stats.Wins != int(item.Id[1]-'0') || item.Stats.Losses != 0 {
+				t.Fatalf("item %+v, only the selected fields and sort keys are read", item)
+			}
+			ids = append(ids, item.Id)
+		}
+		if !page.Info.HasMore {
+			if page.Info.Next != "" {
+				t.Fatal("cursor on the last page")
+			}
+			break
+		}
+		cursor = page.Info.Next
+	}
+	want := []string{"s6", "s4", "s5", "s2", "s3", "s0", "s1"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Fatalf("paged %v, want %v", ids, want)
+	}
+
+	page, err := QueryProjection[testScore]().Sort("-points").Offset(5).Limit(3).Page(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 || page.Items[0].Id != "s0" || page.Info.HasMore || page.Info.Offset != 5 {
+		t.Fatalf("page at offset 5: %+v", page)
+	}
+
+	// scores without points sort first, pages starting or ending on them skip nothing
+	if _, err := DB.GetCollection(testScore{}.Name()).InsertMany(ctx, []any{
+		bson.M{"_id": "n0", "player": "n0"}, bson.M{"_id": "n1", "player": "n1", "points": nil},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for sort, want := range map[string][]string{
+		"points":  {"n0", "n1", "s0", "s1", "s2", "s3", "s4", "s5", "s6"},
+		"-points": {"s6", "s4", "s5", "s2", "s3", "s0", "s1", "n0", "n1"},
+	} {
+		ids := []string{}
+		cursor := ""
+		for pages := 0; pages <= len(want); pages++ {
+			page, err := QueryProjection[testScore]().Sort(sort).Limit(2).After(cursor).Page(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range page.Items {
+				ids = append(ids, item.Id)
+			}
+			if !page.Info.HasMore {
+				break
+			}
+			cursor = page.Info.Next
+		}
+		if !reflect.DeepEqual(ids, want) {
+			t.Fatalf("sorted by %s paged %v, want %v", sort, ids, want)
+		}
+	}
+}
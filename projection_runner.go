@@ -0,0 +1,279 @@
+package nues
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Consistency int
+
+const (
+	// ConsistencyDefault catches up synchronous projections and reads async ones as they are
+	ConsistencyDefault Consistency = iota
+	// ConsistencyEventual never waits, the projection may miss the latest events
+	ConsistencyEventual
+	// ConsistencyStrong reads once the projection applied every event registered before the read
+	ConsistencyStrong
+)
+
+const (
+	projectionLeaseTTL     = 30 * time.Second
+	projectionPollInterval = time.Second
+	projectionWaitMax      = 200 * time.Millisecond
+	defaultReadWaitTimeout = 5 * time.Second
+
+	// HeaderSequence carries the sequence of a command response, HeaderMinSequence the one a query waits for
+	HeaderSequence    = "X-Nues-Sequence"
+	HeaderMinSequence = "X-Nues-Min-Sequence"
+)
+
+type readConsistencyKey struct{}
+
+type readConsistency struct {
+	mode   Consistency
+	minSeq int64
+}
+
+// WithConsistency sets the consistency of the projection reads made with ctx
+func WithConsistency(ctx context.Context, mode Consistency) context.Context {
+	rc := readConsistencyFrom(ctx)
+	rc.mode = mode
+	return context.WithValue(ctx, readConsistencyKey{}, rc)
+}
+
+// WithMinSequence makes the projection reads made with ctx wait until the events up to seq are applied
+func WithMinSequence(ctx context.Context, seq int64) context.Context {
+	rc := readConsistencyFrom(ctx)
+	rc.minSeq = seq
+	return context.WithValue(ctx, readConsistencyKey{}, rc)
+}
+
+func readConsistencyFrom(ctx context.Context) readConsistency {
+	rc, _ := ctx.Value(readConsistencyKey{}).(readConsistency)
+	return rc
+}
+
+// asyncProjections holds the names of the projections kept up to date by a runner
+var asyncProjections sync.Map
+
+func isAsyncProjection(name string) bool {
+	_, found := asyncProjections.Load(name)
+	return found
+}
+
+// ProjectionRunner keeps a projection up to date in the background, see Nues.Projections
+type ProjectionRunner interface {
+	start(ctx context.Context)
+}
+
+// AsyncProjection makes T an async projection: one instance of the service applies new events
+// as they are registered and reads no longer catch up, see WithConsistency
+func AsyncProjection[T Projection]() ProjectionRunner {
+	return &projectionRunner[T]{}
+}
+
+type projectionRunner[T Projection] struct{}
+
+// RegisterProjection makes a synchronous projection T known from the start, for the admin routes
+// and the metrics, instead of from its first read
+func RegisterProjection[T Projection]() ProjectionRunner {
+	return &projectionRegistration[T]{}
+}
+
+type projectionRegistration[T Projection] struct{}
+
+func (r *projectionRegistration[T]) start(ctx context.Context) {
+	var p T
+	registerProjection(p)
+}
+
+func (r *projectionRunner[T]) start(ctx context.Context) {
+	var p T
+	asyncProjections.Store(p.Name(), true)
+	registerProjection(p)
+	if isLocalProjection(p) {
+		// the store lives in the process, every instance keeps its own copy up to date
+		go func() {
+			for {
+				err := r.follow(ctx, false)
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("projection runner stopped", "proj", p.Name(), "err", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(projectionLeaseTTL / 3):
+				}
+			}
+		}()
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(projectionLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			// the root must exist to hold the lease
+			if _, err := loadProjectionRoot(ctx, p); err != nil {
+				slog.Error("projection runner failed", "proj", p.Name(), "err", err)
+			} else if acquired, err := acquireProjectionLease(ctx, p.Name()); err != nil {
+				slog.Error("projection lease failed", "proj", p.Name(), "err", err)
+			} else if acquired {
+				err := r.follow(ctx, true)
+				if ctx.Err() != nil {
+					releaseProjectionLease(context.WithoutCancel(ctx), p.Name())
+					return
+				}
+				slog.Error("projection runner stopped", "proj", p.Name(), "err", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// follow catches up then applies new events as the change stream reports them, polling when streams
+// are not available, until the lease is lost or ctx is done
+func (r *projectionRunner[T]) follow(ctx context.Context, leased bool) error {
+	var p T
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	go func() {
+		if !leased {
+			return
+		}
+		ticker := time.NewTicker(projectionLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			acquired, err := acquireProjectionLease(ctx, p.Name())
+			if err == nil && !acquired {
+				err = ErrProjectionFailed
+			}
+			if err != nil {
+				cancel(err)
+				return
+			}
+		}
+	}()
+
+	match := bson.D{{"operationType", "insert"}, {"fullDocument.name", bson.M{"$in": p.Steams()}}}
+	st, err := DB.Events().Watch(ctx, mongo.Pipeline{bson.D{{"$match", match}}})
+	if err != nil {
+		slog.WarnContext(ctx, "projection change stream unavailable, polling", "proj", p.Name(), "err", err)
+		st = nil
+	} else {
+		defer st.Close(context.WithoutCancel(ctx))
+	}
+
+	for {
+		m := projectionLock(p.Name())
+		m.Lock()
+		runCtx, span := startSpan(ctx, "projection runner "+p.Name(), trace.SpanKindInternal, attribute.String("nues.projection", p.Name()))
+		err := BuildProjection[T](runCtx)
+		endSpan(span, err)
+		m.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if st != nil {
+			if !st.Next(ctx) {
+				if err := context.Cause(ctx); err != nil {
+					return err
+				}
+				return st.Err()
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(projectionPollInterval):
+		}
+	}
+}
+
+// acquireProjectionLease takes or renews the right to update the projection
+func acquireProjectionLease(ctx context.Context, name string) (bool, error) {
+	now := time.Now()
+	res, err := DB.GetCollection(nues.colProjections).UpdateOne(ctx,
+		bson.M{"_id": name, "$or": bson.A{
+			bson.M{"runner": nues.ServiceId},
+			bson.M{"lease_until": bson.M{"$lt": now}},
+			bson.M{"lease_until": bson.M{"$exists": false}},
+		}},
+		bson.M{"$set": bson.M{"runner": nues.ServiceId, "lease_until": now.Add(projectionLeaseTTL)}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+func releaseProjectionLease(ctx context.Context, name string) {
+	_, err := DB.GetCollection(nues.colProjections).UpdateOne(ctx, bson.M{"_id": name, "runner": nues.ServiceId},
+		bson.M{"$unset": bson.M{"runner": "", "lease_until": ""}})
+	if err != nil {
+		slog.Error("projection lease release failed", "proj", name, "err", err)
+	}
+}
+
+func readWaitTimeout() time.Duration {
+	if nues.ReadWaitTimeout > 0 {
+		return nues.ReadWaitTimeout
+	}
+	return defaultReadWaitTimeout
+}
+
+// waitProjection blocks until the async projection p reached what the read consistency asks,
+// ErrProjectionLagging after ReadWaitTimeout
+func waitProjection(ctx context.Context, p Projection) error {
+	rc := readConsistencyFrom(ctx)
+	if rc.mode != ConsistencyStrong && rc.minSeq <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, readWaitTimeout())
+	defer cancel()
+	query := buildStreamQuery(p.Steams())
+	if rc.mode != ConsistencyStrong {
+		query = append(query, bson.E{Key: "sequence", Value: bson.M{"$lte": rc.minSeq}})
+	}
+	target, err := getLastSeq(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	delay := 10 * time.Millisecond
+	for {
+		seq, err := projectionSequence(ctx, p)
+		if err != nil {
+			return err
+		}
+		if seq >= target {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			slog.WarnContext(ctx, "projection wait timed out", "proj", p.Name(), "sequence", seq, "target", target)
+			return ErrProjectionLagging
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, projectionWaitMax)
+	}
+}
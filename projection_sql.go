@@ -0,0 +1,115 @@
+package nues
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+const defaultSqlCheckpointTable = "nues_projections"
+
+type sqlTxKey struct{}
+
+// SqlStore keeps projections in a database/sql database, SQLite or Postgres, with their sequence
+// in a checkpoint table. Handlers write with SqlTx so their rows commit with the checkpoint.
+type SqlStore struct {
+	db    *sql.DB
+	table string
+
+	// ready is set once the checkpoint table exists, a failed creation is tried again by the next call
+	mu    sync.Mutex
+	ready bool
+}
+
+// NewSqlStore stores projections in db, the checkpoints go to the table nues_projections
+func NewSqlStore(db *sql.DB) *SqlStore {
+	return &SqlStore{db: db, table: defaultSqlCheckpointTable}
+}
+
+// DB returns the database to read the projection tables from, after CatchUpProjection
+func (s *SqlStore) DB() *sql.DB {
+	return s.db
+}
+
+// SqlTx returns the transaction of the batch being applied, nil outside of a SqlStore transaction
+func SqlTx(ctx context.Context) *sql.Tx {
+	tx, _ := ctx.Value(sqlTxKey{}).(*sql.Tx)
+	return tx
+}
+
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *SqlStore) conn(ctx context.Context) sqlExecer {
+	if tx := SqlTx(ctx); tx != nil {
+		return tx
+	}
+	return s.db
+}
+
+func (s *SqlStore) init(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ready {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (name VARCHAR(255) PRIMARY KEY, sequence BIGINT NOT NULL)", s.table))
+	if err != nil {
+		return err
+	}
+	s.ready = true
+	return nil
+}
+
+func (s *SqlStore) Sequence(ctx context.Context, name string) (int64, error) {
+	if err := s.init(ctx); err != nil {
+		return 0, err
+	}
+	var seq int64
+	err := s.conn(ctx).QueryRowContext(ctx, fmt.Sprintf("SELECT sequence FROM %s WHERE name = $1", s.table), name).Scan(&seq)
+	if err == sql.ErrNoRows {
+		_, err = s.conn(ctx).ExecContext(ctx,
+			fmt.Sprintf("INSERT INTO %s (name, sequence) VALUES ($1, 0) ON CONFLICT (name) DO NOTHING", s.table), name)
+		return 0, err
+	}
+	return seq, err
+}
+
+func (s *SqlStore) Transact(ctx context.Context, fn func(ctx context.Context) error) error {
+	if SqlTx(ctx) != nil {
+		return fn(ctx)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(context.WithValue(ctx, sqlTxKey{}, tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqlStore) Checkpoint(ctx context.Context, name string, from, to int64) error {
+	res, err := s.conn(ctx).ExecContext(ctx,
+		fmt.Sprintf("UPDATE %s SET sequence = $1 WHERE name = $2 AND sequence = $3", s.table), to, name, from)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrProjectionFailed
+	}
+	return nil
+}
+
+func (s *SqlStore) Reset(ctx context.Context, name string) error {
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+	_, err := s.conn(ctx).ExecContext(ctx, fmt.Sprintf("UPDATE %s SET sequence = 0 WHERE name = $1", s.table), name)
+	return err
+}
@@ -0,0 +1,127 @@
+package nues
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ProjectionStore keeps a projection outside of MongoDB together with the sequence it reflects.
+// The writes of a batch and its checkpoint run in one Transact, handlers reach the transaction
+// through the context they are given, see SqlTx and MemoryStore.
+type ProjectionStore interface {
+	// Sequence returns the sequence of the last event applied to the projection name
+	Sequence(ctx context.Context, name string) (int64, error)
+	// Transact runs fn in a transaction carried by the ctx given to fn, it commits when fn returns nil
+	Transact(ctx context.Context, fn func(ctx context.Context) error) error
+	// Checkpoint moves the sequence of name from from to to, in the transaction of ctx when there is one,
+	// and fails with ErrProjectionFailed when it is not at from anymore
+	Checkpoint(ctx context.Context, name string, from, to int64) error
+	// Reset moves the sequence of name back to 0
+	Reset(ctx context.Context, name string) error
+}
+
+// ProjectionStorage is implemented by projections kept in a ProjectionStore instead of a Mongo collection.
+// They are read from the store once caught up, see CatchUpProjection. Rebuilds into a shadow collection
+// and versions are for Mongo projections, a stored one is reset in place.
+type ProjectionStorage interface {
+	Store() ProjectionStore
+}
+
+// ProjectionCleaner is implemented by stored projections emptying their documents when they are reset,
+// it runs in the transaction of the reset
+type ProjectionCleaner interface {
+	Clear(ctx context.Context) error
+}
+
+// localStore is implemented by stores living in the process, every instance then applies the events itself
+type localStore interface {
+	local() bool
+}
+
+func projectionStore(p Projection) ProjectionStore {
+	if ps, ok := p.(ProjectionStorage); ok {
+		return ps.Store()
+	}
+	return nil
+}
+
+func isLocalProjection(p Projection) bool {
+	ls, ok := projectionStore(p).(localStore)
+	return ok && ls.local()
+}
+
+// CatchUpProjection brings the projection T to what the read consistency of ctx asks, like a read of
+// GetProjection does, for projections read some other way such as stored ones
+func CatchUpProjection[T Projection](ctx context.Context) error {
+	var p T
+	return syncProjection(ctx, p)
+}
+
+// projPrepared holds the stored projections whose CreateIndexes ran in this process
+var projPrepared sync.Map
+
+func buildStoredProjection(ctx context.Context, p Projection, store ProjectionStore) error {
+	if _, prepared := projPrepared.LoadOrStore(p.Name(), true); !prepared {
+		// CreateIndexes prepares the store, creating the tables of a SQL projection for instance
+		if err := p.CreateIndexes(); err != nil {
+			projPrepared.Delete(p.Name())
+			slog.ErrorContext(ctx, "projection store preparation failed", "proj", p.Name(), "err", err)
+			return err
+		}
+	}
+	seq, err := store.Sequence(ctx, p.Name())
+	if err != nil {
+		slog.ErrorContext(ctx, "projection sequence failed", "proj", p.Name(), "err", err)
+		return err
+	}
+	registerProjection(p)
+	_, err = catchUpProjection(ctx, p, seq, func(ctx context.Context, from, to, target int64) error {
+		return store.Checkpoint(ctx, p.Name(), from, to)
+	})
+	return err
+}
+
+// projectionTransact runs fn in a transaction of the store of p, a Mongo one for Mongo projections
+func projectionTransact(ctx context.Context, p Projection, fn func(ctx context.Context) error) error {
+	if store := projectionStore(p); store != nil {
+		return store.Transact(ctx, fn)
+	}
+	session, err := DB.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.WithoutCancel(ctx))
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (any, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// projectionSequence returns the sequence p reflects, from its store or its root
+func projectionSequence(ctx context.Context, p Projection) (int64, error) {
+	if store := projectionStore(p); store != nil {
+		return store.Sequence(ctx, p.Name())
+	}
+	proj := &ProjectionRoot{}
+	err := DB.Projections().FindOne(ctx, bson.M{"_id": p.Name()}).Decode(proj)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return proj.Sequence, err
+}
+
+// resetStoredProjection empties a stored projection and moves it back to 0 in one transaction
+func resetStoredProjection(ctx context.Context, p Projection, store ProjectionStore) error {
+	return store.Transact(ctx, func(ctx context.Context) error {
+		if pc, ok := p.(ProjectionCleaner); ok {
+			if err := pc.Clear(ctx); err != nil {
+				return err
+			}
+		}
+		return store.Reset(ctx, p.Name())
+	})
+}
@@ -0,0 +1,121 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type testBalance struct {
+	Amount int
+}
+
+func TestMemoryStoreWrites(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore[testBalance]()
+
+	m.Put(ctx, "a", testBalance{Amount: 1})
+	m.Put(ctx, "b", testBalance{Amount: 2})
+	m.Delete(ctx, "b")
+	if doc, found := m.Get(ctx, "a"); !found || doc.Amount != 1 {
+		t.Fatalf("a = %+v, %v", doc, found)
+	}
+	if _, found := m.Get(ctx, "b"); found {
+		t.Fatal("deleted document found")
+	}
+	all := m.All(ctx)
+	if len(all) != 1 {
+		t.Fatalf("all = %v", all)
+	}
+	// All returns a copy
+	all["c"] = testBalance{}
+	if _, found := m.Get(ctx, "c"); found {
+		t.Fatal("All shares the store map")
+	}
+}
+
+func TestMemoryStoreTransact(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore[testBalance]()
+	m.Put(ctx, "a", testBalance{Amount: 1})
+
+	err := m.Transact(ctx, func(ctx context.Context) error {
+		m.Put(ctx, "a", testBalance{Amount: 2})
+		m.Put(ctx, "b", testBalance{Amount: 3})
+		// the batch reads its own writes, the others don't see them before the commit
+		if doc, _ := m.Get(ctx, "a"); doc.Amount != 2 {
+			t.Fatalf("a in the batch = %+v", doc)
+		}
+		if doc, _ := m.Get(context.Background(), "a"); doc.Amount != 1 {
+			t.Fatalf("a outside the batch = %+v", doc)
+		}
+		if err := m.Checkpoint(ctx, "balances", 0, 5); err != nil {
+			return err
+		}
+		if seq, _ := m.Sequence(context.Background(), "balances"); seq != 0 {
+			t.Fatalf("sequence outside the batch = %d", seq)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, _ := m.Get(ctx, "b"); doc.Amount != 3 {
+		t.Fatalf("b = %+v", doc)
+	}
+	if seq, _ := m.Sequence(ctx, "balances"); seq != 5 {
+		t.Fatalf("sequence = %d", seq)
+	}
+
+	failed := errors.New("failed")
+	err = m.Transact(ctx, func(ctx context.Context) error {
+		m.Delete(ctx, "a")
+		if err := m.Checkpoint(ctx, "balances", 5, 6); err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("err = %v", err)
+	}
+	if _, found := m.Get(ctx, "a"); !found {
+		t.Fatal("write of a failed batch applied")
+	}
+	if seq, _ := m.Sequence(ctx, "balances"); seq != 5 {
+		t.Fatalf("sequence moved by a failed batch to %d", seq)
+	}
+}
+
+func TestMemoryStoreCheckpointAndReset(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore[testBalance]()
+
+	if err := m.Checkpoint(ctx, "balances", 0, 3); err != nil {
+		t.Fatal(err)
+	}
+	// another builder moved it meanwhile
+	if err := m.Checkpoint(ctx, "balances", 0, 4); err != ErrProjectionFailed {
+		t.Fatalf("err = %v, want %v", err, ErrProjectionFailed)
+	}
+	err := m.Transact(ctx, func(ctx context.Context) error {
+		return m.Checkpoint(ctx, "balances", 2, 4)
+	})
+	if err != ErrProjectionFailed {
+		t.Fatalf("err = %v, want %v", err, ErrProjectionFailed)
+	}
+
+	m.Put(ctx, "a", testBalance{Amount: 1})
+	err = m.Transact(ctx, func(ctx context.Context) error {
+		m.Put(ctx, "b", testBalance{Amount: 2})
+		return m.Reset(ctx, "balances")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := m.All(ctx); len(all) != 0 {
+		t.Fatalf("documents left after reset: %v", all)
+	}
+	if seq, _ := m.Sequence(ctx, "balances"); seq != 0 {
+		t.Fatalf("sequence = %d after reset", seq)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/go-playground/validator/v10"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type QueryResponse map[string]interface{}
@@ -24,10 +25,10 @@ type QueryRoot struct {
 	Ts       string        `json:"ts"`
 }
 
-func (cr *QueryRoot) validate() SysError {
-	err := validate.Struct(cr.Query)
+func (cr *QueryRoot) validate(ctx context.Context) SysError {
+	err := validate.StructCtx(ctx, cr.Query)
 	if err != nil {
-		slog.Error("query validate failed", "err", err)
+		slog.ErrorContext(ctx, "query validate failed", "err", err)
 		var errMsg string
 		for _, err := range err.(validator.ValidationErrors) {
 
@@ -42,9 +43,13 @@ func (cr *QueryRoot) validate() SysError {
 func (q *QueryRoot) Execute(ctx context.Context) {
 
 	start := time.Now()
+	ctx, span := startSpan(ctx, "query "+typeName(q.Query), trace.SpanKindInternal)
+	defer func() {
+		endSpan(span, q.Error)
+	}()
 
-	slog.Debug("validating query")
-	err := q.validate()
+	slog.DebugContext(ctx, "validating query")
+	err := q.validate(ctx)
 	if err != nil {
 		q.Error = err
 		return
@@ -52,10 +57,10 @@ func (q *QueryRoot) Execute(ctx context.Context) {
 
 	q.Response, q.Error = q.Query.Handle(ctx)
 	q.Ts = time.Since(start).String()
-	slog.Debug("QUERY", "target", reflect.TypeOf(q.Query).Elem(), "ts", q.Ts)
+	slog.DebugContext(ctx, "QUERY", "target", reflect.TypeOf(q.Query).Elem(), "ts", q.Ts)
 	q.Executed = true
 	if q.Error != nil {
-		slog.Error("query failed", q.Error)
+		slog.ErrorContext(ctx, "query failed", "err", q.Error)
 	}
 
 }
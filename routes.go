@@ -1,5 +1,7 @@
 package nues
 
+import "time"
+
 type RouteResponse map[string]any
 type RouteCallType int
 type Routes map[string]Route
@@ -8,11 +10,35 @@ const (
 	COMMAND RouteCallType = iota
 	QUERY
 	HANDLER
+	// STREAM routes are served over RPC only, their Handler returns
+	// func(context.Context, map[string]any, func(any) error) error
+	STREAM
 )
 
+// defaultRequestTimeout applies when neither the route nor Nues sets one
+const defaultRequestTimeout = 10 * time.Second
+
 type Route struct {
-	Name    string
-	Public  bool
+	Name   string
+	Public bool
+	// Admin routes only accept the service admin token
+	Admin   bool
 	Call    RouteCallType
 	Handler func() any
+	// Timeout bounds the execution of a single call, falls back to Nues.RequestTimeout
+	Timeout time.Duration
+	// Subscribe lists the events a QUERY route depends on, it can then be subscribed to
+	// at /subscribe/<name> and is pushed again each time one of them is registered, or each time
+	// one affects it when the query is a SubscriptionFilter
+	Subscribe []string
+}
+
+func (r Route) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	if nues.RequestTimeout > 0 {
+		return nues.RequestTimeout
+	}
+	return defaultRequestTimeout
 }
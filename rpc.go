@@ -3,93 +3,150 @@ package nues
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
-	"net/rpc"
-	"slices"
+	"strings"
+	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// RPC calls are JSON over HTTP/2 cleartext: POST /rpc/{route} with a NuesRpcArgs body,
+// the caller credentials in the Authorization header and a NuesRpcResponse or SysErrorData back.
+// STREAM routes answer with newline delimited rpcFrame documents instead.
+const (
+	rpcPathPrefix     = "/rpc/"
+	rpcServiceHeader  = "X-Nues-Service"
+	rpcContentType    = "application/json; charset=utf-8"
+	rpcStreamType     = "application/x-ndjson"
+	rpcMaxRequestSize = 8 << 20
 )
 
-type NuesRpcCall struct{}
 type NuesRpcArgs struct {
-	CommandName string
-	Payload     []byte
-	CallId      string
+	CommandName string          `json:"command_name"`
+	Payload     json.RawMessage `json:"payload"`
+	CallId      string          `json:"call_id"`
+	// Trace carries the caller trace context
+	Trace map[string]string `json:"trace,omitempty"`
+	// MinSequence makes a query wait for the events up to it, see WithMinSequence
+	MinSequence int64 `json:"min_sequence,omitempty"`
 
 	token string
 }
+
 type NuesRpcResponse struct {
-	ServiceId string
-	Response  any
+	ServiceId string `json:"service_id"`
+	Response  any    `json:"response"`
+
+	raw json.RawMessage
+}
+
+// rpcFrame is one message of a stream, the last frame carries Error when the stream failed
+type rpcFrame struct {
+	Data  any           `json:"data,omitempty"`
+	Error *SysErrorData `json:"error,omitempty"`
 }
 
 type NuesRpc struct {
 	Network string
 	context context.Context
+	server  *http.Server
 }
 
+// NuesService is one running instance of a service, Id is its ServiceId
 type NuesService struct {
 	Id   string `bson:"_id" json:"tag"`
 	Name string `json:"name"`
 	Ip   string `json:"ip"`
 	Port string `json:"port"`
+	// ExpiresAt is pushed forward by every heartbeat, the instance is dropped once it passed
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
 }
 
-func initRpc() {
-	nrc := new(NuesRpcCall)
-	rpc.RegisterName("NuesRpcCall", nrc)
-	rpc.HandleHTTP()
-}
+func (n *NuesRpc) serveCall(w http.ResponseWriter, r *http.Request) {
 
-func (n *NuesRpcCall) Call(args *NuesRpcArgs, reply *NuesRpcResponse) error {
+	start := time.Now()
+	var err error
 
-	ctx := context.Background()
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+	args := &NuesRpcArgs{}
+	if err = json.NewDecoder(io.LimitReader(r.Body, rpcMaxRequestSize)).Decode(args); err != nil {
+		writeRpcError(w, http.StatusBadRequest, ErrBadCommand)
+		return
+	}
+	args.CommandName = strings.TrimPrefix(r.URL.Path, rpcPathPrefix)
+	args.token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 
-	var err error
 	route, found := nues.Routes[args.CommandName]
 	if !found {
-		return ErrBadCommand
+		writeRpcError(w, http.StatusNotFound, ErrBadCommand)
+		return
 	}
-	auth := authCall(args.token, route)
+	ctx, cancel := context.WithTimeout(extractTrace(r.Context(), args.Trace), route.timeout())
+	defer cancel()
+	ctx, span := startSpan(ctx, "rpc "+route.Name, trace.SpanKindServer, attribute.String("nues.route", route.Name))
+	defer func() {
+		endSpan(span, err)
+	}()
+	ctx = WithLogAttrs(ctx, slog.String("route", route.Name), slog.String("call_id", args.CallId), slog.String("caller", r.Header.Get(rpcServiceHeader)))
+
+	auth := authCall(ctx, args.token, route)
 	if !auth {
-		return ErrUserNotAuth
+		observeCall("rpc", route, start, nil, ErrUserNotAuth)
+		writeRpcError(w, http.StatusUnauthorized, ErrUserNotAuth)
+		return
+	}
+	if !route.Public {
+		ctx = WithLogAttrs(ctx, slog.String("identity", tokenIdentity(args.token)))
+	}
+
+	if route.Call == STREAM {
+		err = rpcStream(ctx, route, args, w)
+		observeCall("rpc", route, start, nil, err)
+		return
 	}
 
-	callId := args.CallId
-	var called bool = false
 	var response any
-	if callId != "" {
-		// try call history
-		var call bson.M
-		err := DB.GetCollection(nues.colCommands).FindOne(context.TODO(), bson.M{"_id": callId}).Decode(&call)
-		if err != nil && err != mongo.ErrNoDocuments {
-			return ErrSystemInternal
-		}
-		if call != nil {
-			//Idempotency detected
-			called = true
-			response = call["response"]
-		}
+	response, err = rpcServe(ctx, route, args)
+	observeCall("rpc", route, start, response, err)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "rpc failed", "err", err)
+		writeRpcError(w, http.StatusBadRequest, ErrBadCommand)
+		return
 	}
-	if !called {
-		response, err = rpcServe(ctx, route, args)
+	if status := responseStatus(response); status != http.StatusOK {
+		// a call in progress is retried by the client, which only reads the status
+		writeRpcError(w, status, response.(*CommandRoot).Error)
+		return
 	}
-
+	w.Header().Set("content-type", rpcContentType)
+	err = json.NewEncoder(w).Encode(NuesRpcResponse{
+		Response:  response,
+		ServiceId: nues.ServiceId,
+	})
 	if err != nil {
-		slog.Error("http failed", "err", err)
-		return ErrBadCommand
-	} else {
-		reply = &NuesRpcResponse{
-			Response:  response,
-			ServiceId: nues.ServiceId,
-		}
+		slog.ErrorContext(ctx, "rpc response error", "err", err)
 	}
-	return nil
+}
 
+func writeRpcError(w http.ResponseWriter, status int, sysErr SysError) {
+	var body SysErrorData
+	if !errors.As(sysErr, &body) {
+		body = ErrSystemInternal.(SysErrorData)
+	}
+	w.Header().Set("content-type", rpcContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
 }
 
 func rpcServe(ctx context.Context, route Route, args *NuesRpcArgs) (any, error) {
@@ -148,6 +205,9 @@ func rpcServe(ctx context.Context, route Route, args *NuesRpcArgs) (any, error)
 				return nil, ErrBadCommand
 			}
 		}
+		if args.MinSequence > 0 {
+			ctx = WithMinSequence(ctx, args.MinSequence)
+		}
 		queryRoot := &QueryRoot{
 			Query: query,
 		}
@@ -157,60 +217,93 @@ func rpcServe(ctx context.Context, route Route, args *NuesRpcArgs) (any, error)
 	return nil, ErrSystemInternal
 }
 
+// rpcStream runs a STREAM route, every value it sends is flushed to the caller as one frame
+func rpcStream(ctx context.Context, route Route, args *NuesRpcArgs, w http.ResponseWriter) error {
+
+	handler, ok := route.Handler().(func(context.Context, map[string]any, func(any) error) error)
+	if !ok {
+		writeRpcError(w, http.StatusBadRequest, ErrSystemInternal)
+		return ErrSystemInternal
+	}
+	reqBody := make(map[string]any)
+	if len(args.Payload) > 0 {
+		if err := json.Unmarshal(args.Payload, &reqBody); err != nil {
+			writeRpcError(w, http.StatusBadRequest, ErrBadCommand)
+			return ErrBadCommand
+		}
+	}
+
+	w.Header().Set("content-type", rpcStreamType)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	send := func(v any) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := enc.Encode(rpcFrame{Data: v}); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	err := handler(ctx, reqBody, send)
+	if err != nil {
+		slog.ErrorContext(ctx, "rpc stream failed", "err", err)
+		var sysErr SysErrorData
+		if !errors.As(err, &sysErr) {
+			sysErr = ErrSystemInternal.(SysErrorData)
+		}
+		enc.Encode(rpcFrame{Error: &sysErr})
+	}
+	return err
+}
+
 func (n *NuesRpc) Close() error {
-	return nil
+	if n.server == nil {
+		return nil
+	}
+	return n.server.Shutdown(context.TODO())
 }
+
 func (n *NuesRpc) Serve(ctx context.Context) {
 	slog.Info("starting RPC server...")
 	n.context = ctx
 
+	mux := http.NewServeMux()
+	mux.HandleFunc(rpcPathPrefix, n.serveCall)
+	n.server = &http.Server{
+		Handler:        h2c.NewHandler(mux, &http2.Server{}),
+		MaxHeaderBytes: 1 << 20,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
 	l, err := net.Listen(n.Network, nues.RpcPort)
 	if err != nil {
-		slog.Error("listen error:", err)
+		slog.Error("listen error", "err", err)
 		panic(err)
 	}
-	err = http.Serve(l, nil)
-	if err != nil {
+	err = n.server.Serve(l)
+	if err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
 }
 
-func getService(name string) *NuesService {
-	index := slices.IndexFunc[[]NuesService](nues.services, func(s NuesService) bool {
-		return s.Name == name
-	})
-	if index < 0 {
-		slog.Error("service %s not found", name)
-		panic(fmt.Sprintf("service %v not found", name))
+// getService returns a live instance of the service picked by the configured load balancing
+func getService(name string) (*NuesService, error) {
+	service, found := registry.pick(name)
+	if !found {
+		slog.Error("service not found", "service", name)
+		return nil, ErrServiceNotFound
 	}
-	return &nues.services[index]
-
+	return service, nil
 }
 
-func RequestRpc(serviceName, commandName, callId string, payload any) (*NuesRpcResponse, error) {
-	payloadB, err := json.Marshal(payload)
-	if err != nil {
-		return nil, err
-	}
-	args := NuesRpcArgs{
-		CommandName: commandName,
-		token:       nues.adminToken,
-		Payload:     payloadB,
-		CallId:      callId,
-	}
-	service := getService(serviceName)
-	client, err := rpc.DialHTTP("tcp", service.Ip+service.Port)
-	if err != nil {
-		slog.Error("dialing:", err)
-		return nil, err
-	}
-	reply := &NuesRpcResponse{}
-	err = client.Call("NuesRpcCall.Call", args, reply)
-	if err != nil {
-		slog.Error("dialing:", err)
-		return nil, err
-	}
-
-	client.Close()
-	return reply, nil
+func RequestRpc(ctx context.Context, serviceName, commandName, callId string, payload any) (*NuesRpcResponse, error) {
+	return NewRpcClient(serviceName).Call(ctx, commandName, callId, payload)
 }
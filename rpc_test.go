@@ -0,0 +1,217 @@
+package nues
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func chargeHandler() any {
+	return func(ctx context.Context, req map[string]any) RouteResponse {
+		return RouteResponse{"charged": req["amount"]}
+	}
+}
+
+func billingRoutes() Routes {
+	routes := Routes{
+		"bill_charge": {Name: "bill_charge", Call: HANDLER, Handler: chargeHandler},
+		"bill_refund": {Name: "bill_refund", Call: HANDLER, Handler: chargeHandler},
+		"bill_pay":    {Name: "bill_pay", Call: COMMAND, Handler: func() any { return &CmdTestCharge{} }},
+		"bill_feed": {Name: "bill_feed", Call: STREAM, Handler: func() any {
+			return func(ctx context.Context, req map[string]any, send func(any) error) error {
+				for i := 0; i < 3; i++ {
+					if err := send(i); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}},
+	}
+	maps.Copy(routes, projectionRoutes())
+	return routes
+}
+
+// TestRpcBillingService is the billing service TestRpcBetweenServices starts in its own process
+func TestRpcBillingService(t *testing.T) {
+	dbName := os.Getenv("NUES_TEST_BILLING_DB")
+	if dbName == "" {
+		t.Skip("started by TestRpcBetweenServices")
+	}
+	connectTestDB(os.Getenv("NUES_TEST_BILLING_ID"), "billing", dbName, billingRoutes())
+	nues.RpcPort = os.Getenv("NUES_TEST_BILLING_PORT")
+	ctx := context.Background()
+	registerSelf(ctx)
+	// serves until the calling test kills the process
+	(&NuesRpc{Network: "tcp"}).Serve(ctx)
+}
+
+// startBillingService runs billing as a second service sharing the database of the test, it is
+// discovered and called like any remote service
+func startBillingService(t *testing.T, ctx context.Context) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, port, _ := net.SplitHostPort(addr)
+
+	billingId := "billing-" + GenerateId()[:8]
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestRpcBillingService$")
+	cmd.Env = append(os.Environ(),
+		"NUES_TEST_BILLING_DB="+nues.DbName,
+		"NUES_TEST_BILLING_ID="+billingId,
+		"NUES_TEST_BILLING_PORT=:"+port,
+	)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("billing service output:\n%s", out.String())
+		}
+	})
+	waitListening(t, addr)
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if err := registry.load(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, found := registry.pick("billing"); found {
+			return billingId
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("billing service not discovered")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestRpcBetweenServices calls billing, running in its own process, as orders. Orders calls with the
+// session of its service identity, which is only allowed some billing routes
+func TestRpcBetweenServices(t *testing.T) {
+	setupTestDB(t, "orders", Routes{})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	orders := Identity{
+		IdentityId:      nues.ServiceId,
+		Name:            nues.ServiceId,
+		AllowedServices: map[string][]string{"billing": {"bill_charge", "bill_feed", "bill_pay"}},
+	}
+	if err := RegisterNewIdentity(ctx, orders); err != nil {
+		t.Fatal(err)
+	}
+	if nues.serviceToken == nues.adminToken {
+		t.Fatal("services must not call with the admin token")
+	}
+	billingId := startBillingService(t, ctx)
+
+	t.Run("allowed route", func(t *testing.T) {
+		res, err := RequestRpc(ctx, "billing", "bill_charge", "", map[string]any{"amount": 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ServiceId != billingId {
+			t.Fatalf("served by %q, want %q", res.ServiceId, billingId)
+		}
+		if got := res.Response.(map[string]any)["charged"]; got != float64(5) {
+			t.Fatalf("charged = %v", got)
+		}
+	})
+
+	t.Run("route not allowed to the caller", func(t *testing.T) {
+		_, err := RequestRpc(ctx, "billing", "bill_refund", "", map[string]any{"amount": 5})
+		if !errors.Is(err, ErrUserNotAuth) {
+			t.Fatalf("err = %v, want %v", err, ErrUserNotAuth)
+		}
+	})
+
+	t.Run("service tokens are not admin", func(t *testing.T) {
+		_, err := RequestRpc(ctx, "billing", "nues_projections", "", map[string]any{})
+		if !errors.Is(err, ErrUserNotAuth) {
+			t.Fatalf("err = %v, want %v", err, ErrUserNotAuth)
+		}
+	})
+
+	t.Run("call in progress is retried", func(t *testing.T) {
+		callId := GenerateId()
+		hash, err := fingerprint("CmdTestCharge", &CmdTestCharge{Amount: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reserveCall(ctx, callId, hash); err != nil {
+			t.Fatal(err)
+		}
+		// another caller holds the callId for a while, the client keeps retrying until it is free
+		nues.RpcRetries = 10
+		defer func() { nues.RpcRetries = 0 }()
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			releaseCall(ctx, callId)
+		}()
+		res, err := CallCommand[CmdTestCharge, map[string]any](ctx, "billing", "bill_pay", callId, CmdTestCharge{Amount: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res["charged"] != float64(5) {
+			t.Fatalf("charged = %v", res["charged"])
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		got := []int{}
+		err := NewRpcClient("billing").Stream(ctx, "bill_feed", map[string]any{}, func(msg json.RawMessage) error {
+			var n int
+			if err := json.Unmarshal(msg, &n); err != nil {
+				return err
+			}
+			got = append(got, n)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 3 || got[2] != 2 {
+			t.Fatalf("received %v", got)
+		}
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		token := nues.serviceToken
+		nues.serviceToken = orders.IdentityId + ":" + GenerateId()
+		defer func() { nues.serviceToken = token }()
+		_, err := RequestRpc(ctx, "billing", "bill_charge", "", map[string]any{"amount": 5})
+		if !errors.Is(err, ErrUserNotAuth) {
+			t.Fatalf("err = %v, want %v", err, ErrUserNotAuth)
+		}
+	})
+}
+
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%s not listening", addr)
+}
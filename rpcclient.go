@@ -0,0 +1,355 @@
+package nues
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultRpcRetries  = 3
+	rpcBackoffBase     = 100 * time.Millisecond
+	rpcBackoffMax      = 2 * time.Second
+	breakerThreshold   = 5
+	breakerOpenTimeout = 30 * time.Second
+)
+
+// rpcClients pools one RpcClient, and so one set of connections, per target service
+var rpcClients sync.Map
+
+// breakers holds one circuitBreaker per service instance id
+var breakers sync.Map
+
+// RpcClient calls the routes of another service, authenticated with this service credentials
+type RpcClient struct {
+	Service string
+
+	http *http.Client
+}
+
+// NewRpcClient returns the pooled client of serviceName
+func NewRpcClient(serviceName string) *RpcClient {
+	if c, ok := rpcClients.Load(serviceName); ok {
+		return c.(*RpcClient)
+	}
+	c, _ := rpcClients.LoadOrStore(serviceName, &RpcClient{
+		Service: serviceName,
+		http: &http.Client{
+			// HTTP/2 cleartext, calls to the same instance share one connection
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+			},
+		},
+	})
+	return c.(*RpcClient)
+}
+
+// Call runs a COMMAND, QUERY or HANDLER route of the service, a remote failure is returned as SysErrorData.
+// Calls carrying a callId are idempotent on the remote side so they are retried on transient failures.
+func (c *RpcClient) Call(ctx context.Context, route, callId string, payload any) (resp *NuesRpcResponse, err error) {
+
+	start := time.Now()
+	ctx, cancel := withRpcTimeout(ctx)
+	defer cancel()
+	ctx, span := startSpan(ctx, "rpc "+c.Service+"/"+route, trace.SpanKindClient, attribute.String("nues.service", c.Service))
+	defer func() {
+		observeRpcClient(c.Service, route, start, err)
+		endSpan(span, err)
+	}()
+
+	attempts := 1
+	if callId != "" {
+		attempts += rpcRetries()
+	}
+	var res *http.Response
+	for attempt := 0; ; attempt++ {
+		res, err = c.post(ctx, route, callId, payload)
+		if err == nil || attempt+1 >= attempts || !isRetryable(err) {
+			break
+		}
+		slog.WarnContext(ctx, "rpc call retry", "service", c.Service, "attempt", attempt+1, "err", err)
+		if !sleepBackoff(ctx, attempt) {
+			break
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "rpc call failed", "service", c.Service, "err", err)
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		ServiceId string          `json:"service_id"`
+		Response  json.RawMessage `json:"response"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	resp = &NuesRpcResponse{
+		ServiceId: body.ServiceId,
+		raw:       body.Response,
+	}
+	if err = json.Unmarshal(body.Response, &resp.Response); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Stream runs a STREAM route of the service and hands every received message to recv, it is never retried
+func (c *RpcClient) Stream(ctx context.Context, route string, payload any, recv func(json.RawMessage) error) (err error) {
+
+	start := time.Now()
+	ctx, span := startSpan(ctx, "rpc stream "+c.Service+"/"+route, trace.SpanKindClient, attribute.String("nues.service", c.Service))
+	defer func() {
+		observeRpcClient(c.Service, route, start, err)
+		endSpan(span, err)
+	}()
+
+	res, err := c.post(ctx, route, "", payload)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var frame struct {
+			Data  json.RawMessage `json:"data"`
+			Error *SysErrorData   `json:"error"`
+		}
+		if err = dec.Decode(&frame); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if frame.Error != nil {
+			return *frame.Error
+		}
+		if err = recv(frame.Data); err != nil {
+			return err
+		}
+	}
+}
+
+// post sends the call to an instance of the service and returns the response when the remote accepted it
+func (c *RpcClient) post(ctx context.Context, route, callId string, payload any) (*http.Response, error) {
+
+	payloadB, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	args := NuesRpcArgs{
+		CommandName: route,
+		Payload:     payloadB,
+		CallId:      callId,
+		Trace:       injectTrace(ctx),
+		MinSequence: readConsistencyFrom(ctx).minSeq,
+	}
+	body, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := getService(c.Service)
+	if err != nil {
+		return nil, err
+	}
+	breaker := breakerFor(service.Id)
+	if !breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+	// every call let through is reported, a trial call left unreported would keep the breaker open
+	healthy := false
+	defer func() {
+		breaker.report(healthy)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+service.Ip+service.Port+rpcPathPrefix+route, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", rpcContentType)
+	req.Header.Set("Authorization", "Bearer "+nues.serviceToken)
+	req.Header.Set(rpcServiceHeader, nues.ServiceId)
+
+	done := registry.acquire(service.Id)
+	res, err := c.http.Do(req)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	// the call stays pending until the caller closes the body
+	res.Body = &pendingBody{ReadCloser: res.Body, done: done}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		healthy = res.StatusCode < http.StatusInternalServerError
+		var sysErr SysErrorData
+		if err := json.NewDecoder(res.Body).Decode(&sysErr); err != nil {
+			return nil, NewError(ErrSystemInternal.(SysErrorData).Code, res.Status)
+		}
+		return nil, sysErr
+	}
+	healthy = true
+	return res, nil
+}
+
+type pendingBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *pendingBody) Close() error {
+	b.done()
+	return b.ReadCloser.Close()
+}
+
+func withRpcTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	timeout := nues.RpcTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func rpcRetries() int {
+	if nues.RpcRetries > 0 {
+		return nues.RpcRetries
+	}
+	return defaultRpcRetries
+}
+
+// isRetryable tells if a failed call may succeed when sent again
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var sysErr SysErrorData
+	if !errors.As(err, &sysErr) {
+		// transport failure
+		return true
+	}
+	return sysErr.Code == ErrSystemInternal.(SysErrorData).Code || sysErr.Code == ErrCallInProgress.(SysErrorData).Code
+}
+
+// sleepBackoff waits an exponential delay with full jitter, false when ctx ended first
+func sleepBackoff(ctx context.Context, attempt int) bool {
+	delay := rpcBackoffBase << attempt
+	if delay > rpcBackoffMax || delay <= 0 {
+		delay = rpcBackoffMax
+	}
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(delay)) + 1))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// circuitBreaker stops calling an instance after breakerThreshold consecutive failures,
+// after breakerOpenTimeout a single trial call decides if it closes again
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func breakerFor(instanceId string) *circuitBreaker {
+	b, _ := breakers.LoadOrStore(instanceId, &circuitBreaker{})
+	return b.(*circuitBreaker)
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// isOpen tells if the breaker rejects calls right now, it does not take the trial call
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= breakerThreshold && (time.Now().Before(b.openUntil) || b.trial)
+}
+
+func (b *circuitBreaker) report(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openUntil = time.Now().Add(breakerOpenTimeout)
+	}
+}
+
+// remoteRoot is the wire shape shared by CommandRoot and QueryRoot
+type remoteRoot[Resp any] struct {
+	Response Resp          `json:"response"`
+	Executed bool          `json:"executed"`
+	Error    *SysErrorData `json:"error"`
+}
+
+// CallCommand runs the COMMAND route of serviceName and decodes its response,
+// the remote SysError is returned as the error with its original code
+func CallCommand[Req any, Resp any](ctx context.Context, serviceName, route, callId string, req Req) (Resp, error) {
+	return callRoot[Resp](ctx, serviceName, route, callId, req)
+}
+
+// CallQuery runs the QUERY route of serviceName and decodes its response
+func CallQuery[Req any, Resp any](ctx context.Context, serviceName, route string, req Req) (Resp, error) {
+	return callRoot[Resp](ctx, serviceName, route, "", req)
+}
+
+func callRoot[Resp any](ctx context.Context, serviceName, route, callId string, req any) (Resp, error) {
+	var zero Resp
+	res, err := NewRpcClient(serviceName).Call(ctx, route, callId, req)
+	if err != nil {
+		return zero, err
+	}
+	var root remoteRoot[Resp]
+	if err := json.Unmarshal(res.raw, &root); err != nil {
+		slog.ErrorContext(ctx, "rpc response decode failed", "service", serviceName, "route", route, "err", err)
+		return zero, ErrParsingData
+	}
+	if root.Error != nil {
+		return zero, *root.Error
+	}
+	if !root.Executed {
+		return zero, ErrSystemInternal
+	}
+	return root.Response, nil
+}
@@ -0,0 +1,128 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSleepBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sleepBackoff(ctx, 0) {
+		t.Fatal("backoff slept past a cancelled context")
+	}
+
+	for _, tc := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, rpcBackoffBase},
+		{2, rpcBackoffBase << 2},
+		// capped, shifting past the int64 range too
+		{63, rpcBackoffMax},
+	} {
+		start := time.Now()
+		if !sleepBackoff(context.Background(), tc.attempt) {
+			t.Fatalf("attempt %d did not sleep", tc.attempt)
+		}
+		if elapsed := time.Since(start); elapsed > tc.max+100*time.Millisecond {
+			t.Fatalf("attempt %d slept %s, at most %s", tc.attempt, elapsed, tc.max)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("connection refused"), true},
+		{ErrSystemInternal, true},
+		{ErrCallInProgress, true},
+		{ErrCallConflict, false},
+		{ErrUserNotAuth, false},
+		{context.DeadlineExceeded, false},
+	} {
+		if got := isRetryable(tc.err); got != tc.retryable {
+			t.Fatalf("isRetryable(%v) = %v", tc.err, got)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{}
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			if !b.allow() {
+				t.Fatalf("call %d rejected", i)
+			}
+			b.report(false)
+		}
+	}
+
+	// a success resets the failures
+	fail(breakerThreshold - 1)
+	b.report(true)
+	fail(breakerThreshold - 1)
+	if b.isOpen() {
+		t.Fatal("breaker opened before the threshold")
+	}
+
+	fail(1)
+	if !b.isOpen() || b.allow() {
+		t.Fatal("breaker not open at the threshold")
+	}
+
+	// once the timeout passed a single trial call goes through
+	b.openUntil = time.Now().Add(-time.Millisecond)
+	if !b.allow() {
+		t.Fatal("trial call rejected")
+	}
+	if b.allow() || !b.isOpen() {
+		t.Fatal("second call let through during the trial")
+	}
+	// a failed trial opens it again
+	b.report(false)
+	if b.allow() {
+		t.Fatal("breaker closed by a failed trial")
+	}
+
+	b.openUntil = time.Now().Add(-time.Millisecond)
+	if !b.allow() {
+		t.Fatal("trial call rejected")
+	}
+	b.report(true)
+	if b.isOpen() || !b.allow() || !b.allow() {
+		t.Fatal("breaker still open after a successful trial")
+	}
+}
+
+// TestBreakerTrialReported checks a trial call failing before it is sent still ends the trial
+func TestBreakerTrialReported(t *testing.T) {
+	instance := NuesService{Id: "billing-" + GenerateId()[:8], Name: "billing-trial", Ip: "%zz", Port: ":1", ExpiresAt: time.Now().Add(time.Minute)}
+	registry.mu.Lock()
+	registry.instances[instance.Id] = instance
+	registry.mu.Unlock()
+	t.Cleanup(func() {
+		registry.mu.Lock()
+		delete(registry.instances, instance.Id)
+		registry.mu.Unlock()
+		breakers.Delete(instance.Id)
+	})
+	b := breakerFor(instance.Id)
+	b.failures = breakerThreshold
+	b.openUntil = time.Now().Add(-time.Millisecond)
+
+	if _, err := NewRpcClient(instance.Name).post(context.Background(), "bill_charge", "", map[string]any{}); err == nil {
+		t.Fatal("call to an invalid address succeeded")
+	}
+	if b.trial {
+		t.Fatal("trial call left unreported")
+	}
+	// the failed trial reopened the breaker until the next timeout
+	if !b.isOpen() {
+		t.Fatal("breaker closed by a failed trial")
+	}
+}
@@ -0,0 +1,385 @@
+package nues
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SagaRunning     = "running"
+	SagaCompleted   = "completed"
+	SagaCompensated = "compensated"
+
+	sagaTimeoutPoll  = 5 * time.Second
+	sagaTimeoutLease = time.Minute
+	// sagaAppliedMax is how many event ids an instance remembers, redeliveries come shortly after
+	// the delivery so older ids are dropped
+	sagaAppliedMax = 256
+)
+
+// SagaCommand is a call issued by a saga, it is delivered through the outbox
+type SagaCommand struct {
+	Service string `bson:"service" json:"service"`
+	Route   string `bson:"route" json:"route"`
+	Payload string `bson:"payload" json:"payload"`
+}
+
+// Decode unmarshals the JSON payload of the command into v
+func (c SagaCommand) Decode(v any) error {
+	return json.Unmarshal([]byte(c.Payload), v)
+}
+
+// sagaRecord is the durable state of one saga instance, Data holds the saga own state
+type sagaRecord[T any] struct {
+	Id     string `bson:"_id"`
+	Saga   string `bson:"saga"`
+	Key    string `bson:"key"`
+	Status string `bson:"status"`
+	Data   T      `bson:"data"`
+	// Compensation is run in reverse order when the saga fails
+	Compensation []SagaCommand `bson:"compensation"`
+	// Applied are the ids of the last events handled, watchers deliver at least once
+	Applied  []string   `bson:"applied"`
+	Deadline *time.Time `bson:"deadline,omitempty"`
+	Reason   string     `bson:"reason,omitempty"`
+	Version  int64      `bson:"version"`
+	Created  time.Time  `bson:"created"`
+	Updated  time.Time  `bson:"updated"`
+}
+
+// SagaContext is given to the saga handlers to read and change the instance state and issue commands.
+// Nothing is persisted or sent unless the handler returns without error.
+type SagaContext[T any] struct {
+	Key  string
+	Data *T
+
+	rec  *sagaRecord[T]
+	sent []SagaCommand
+	now  time.Time
+}
+
+// Send issues a command to a route of this service
+func (sc *SagaContext[T]) Send(route string, payload any) error {
+	return sc.Call(nues.ServiceName, route, payload)
+}
+
+// Call issues a command to a route of serviceName
+func (sc *SagaContext[T]) Call(serviceName, route string, payload any) error {
+	cmd, err := sagaCommand(serviceName, route, payload)
+	if err != nil {
+		return err
+	}
+	sc.sent = append(sc.sent, cmd)
+	return nil
+}
+
+// Compensate registers the command undoing a completed step, it is sent if the saga fails later
+func (sc *SagaContext[T]) Compensate(serviceName, route string, payload any) error {
+	cmd, err := sagaCommand(serviceName, route, payload)
+	if err != nil {
+		return err
+	}
+	sc.rec.Compensation = append(sc.rec.Compensation, cmd)
+	return nil
+}
+
+// Timeout makes the saga OnTimeout run once d passed, it replaces the previous timeout
+func (sc *SagaContext[T]) Timeout(d time.Duration) {
+	deadline := sc.now.Add(d)
+	sc.rec.Deadline = &deadline
+}
+
+func (sc *SagaContext[T]) CancelTimeout() {
+	sc.rec.Deadline = nil
+}
+
+// Complete ends the saga, later events for its key are ignored
+func (sc *SagaContext[T]) Complete() {
+	sc.rec.Status = SagaCompleted
+	sc.rec.Deadline = nil
+}
+
+// Fail ends the saga and sends the registered compensations, last registered first
+func (sc *SagaContext[T]) Fail(reason string) {
+	for i := len(sc.rec.Compensation) - 1; i >= 0; i-- {
+		sc.sent = append(sc.sent, sc.rec.Compensation[i])
+	}
+	sc.rec.Status = SagaCompensated
+	sc.rec.Reason = reason
+	sc.rec.Deadline = nil
+}
+
+func (sc *SagaContext[T]) Status() string {
+	return sc.rec.Status
+}
+
+func sagaCommand(serviceName, route string, payload any) (SagaCommand, error) {
+	if serviceName == "" || route == "" {
+		return SagaCommand{}, ErrBadCommand
+	}
+	payloadB, err := json.Marshal(payload)
+	if err != nil {
+		return SagaCommand{}, ErrBadCommand
+	}
+	return SagaCommand{Service: serviceName, Route: route, Payload: string(payloadB)}, nil
+}
+
+// SagaHandler reacts to an event of the saga instance
+type SagaHandler[T any] func(ctx context.Context, sc *SagaContext[T], ev Event) error
+
+type sagaStep[T any] struct {
+	start  bool
+	key    func(Event) string
+	handle SagaHandler[T]
+}
+
+// Saga coordinates a process spanning several commands, one instance runs per correlation key.
+// Its events are handled one at a time in the order they were registered. Handlers returning a
+// SysError other than ErrSystemInternal fail the saga, other errors leave the instance untouched
+// and the event is handled again with backoff until it succeeds.
+type Saga[T any] struct {
+	Name string
+	// OnTimeout runs once the deadline set with SagaContext.Timeout passed, without it the saga fails
+	OnTimeout func(ctx context.Context, sc *SagaContext[T]) error
+
+	steps map[string]sagaStep[T]
+}
+
+// SagaDefinition is a saga started with the service, see Nues.Sagas
+type SagaDefinition interface {
+	start(ctx context.Context) error
+}
+
+func NewSaga[T any](name string) *Saga[T] {
+	return &Saga[T]{
+		Name:  name,
+		steps: map[string]sagaStep[T]{},
+	}
+}
+
+// StartOn creates the instance keyed by key(ev) when eventName happens
+func (s *Saga[T]) StartOn(eventName string, key func(Event) string, handle SagaHandler[T]) *Saga[T] {
+	s.steps[eventName] = sagaStep[T]{start: true, key: key, handle: handle}
+	return s
+}
+
+// On handles eventName for the running instance keyed by key(ev), events without instance are ignored
+func (s *Saga[T]) On(eventName string, key func(Event) string, handle SagaHandler[T]) *Saga[T] {
+	s.steps[eventName] = sagaStep[T]{key: key, handle: handle}
+	return s
+}
+
+func (s *Saga[T]) start(ctx context.Context) error {
+	_, err := DB.GetCollection(nues.colSagas).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "saga", Value: 1}, {Key: "status", Value: 1}, {Key: "deadline", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	store := mongoSagaStore[T]{}
+	eventNames := []string{}
+	for eventName := range s.steps {
+		eventNames = append(eventNames, eventName)
+	}
+	slices.Sort(eventNames)
+	// one watcher for every step, an instance sees its events in order
+	err = DB.watchEvents(ctx, eventNames, WatchOptions{Group: "saga_" + s.Name}, func(ctx context.Context, ev Event) error {
+		return s.handleEvent(ctx, store, ev)
+	})
+	if err != nil {
+		return err
+	}
+	go s.runTimeouts(ctx, store)
+	return nil
+}
+
+func (s *Saga[T]) handleEvent(ctx context.Context, store sagaStore[T], ev Event) error {
+	step, found := s.steps[ev.Name]
+	if !found {
+		return nil
+	}
+	key := step.key(ev)
+	if key == "" {
+		slog.WarnContext(ctx, "saga event without key", "saga", s.Name, "ev", ev.Name, "seq", ev.Sequence)
+		return nil
+	}
+	return s.process(ctx, store, key, step.start, ev.Id, func(ctx context.Context, sc *SagaContext[T]) error {
+		return step.handle(ctx, sc, ev)
+	})
+}
+
+func (s *Saga[T]) handleTimeout(ctx context.Context, store sagaStore[T], key string) error {
+	return s.process(ctx, store, key, false, "", func(ctx context.Context, sc *SagaContext[T]) error {
+		sc.CancelTimeout()
+		if s.OnTimeout == nil {
+			sc.Fail("timeout")
+			return nil
+		}
+		return s.OnTimeout(ctx, sc)
+	})
+}
+
+// process loads the instance of key, runs fn on it and saves it with the issued commands in one transaction
+func (s *Saga[T]) process(ctx context.Context, store sagaStore[T], key string, create bool, eventId string, fn func(context.Context, *SagaContext[T]) error) (err error) {
+
+	ctx, span := startSpan(ctx, "saga "+s.Name, trace.SpanKindInternal, attribute.String("nues.saga_key", key))
+	defer func() {
+		endSpan(span, err)
+	}()
+	ctx = WithLogAttrs(ctx, slog.String("saga", s.Name), slog.String("saga_key", key))
+
+	return store.transact(ctx, func(ctx context.Context) error {
+		now := store.now()
+		load := func() (*sagaRecord[T], error) {
+			rec, err := store.load(ctx, s.Name+":"+key)
+			if rec == nil && err == nil && create {
+				rec = &sagaRecord[T]{
+					Id:      s.Name + ":" + key,
+					Saga:    s.Name,
+					Key:     key,
+					Status:  SagaRunning,
+					Created: now,
+				}
+			}
+			return rec, err
+		}
+		rec, err := load()
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			slog.DebugContext(ctx, "no saga instance for event")
+			return nil
+		}
+		if rec.Status != SagaRunning || (eventId != "" && slices.Contains(rec.Applied, eventId)) {
+			return nil
+		}
+
+		sc := &SagaContext[T]{Key: key, Data: &rec.Data, rec: rec, now: now}
+		if err := fn(ctx, sc); err != nil {
+			var sysErr SysErrorData
+			if !errors.As(err, &sysErr) || sysErr.Code == ErrSystemInternal.(SysErrorData).Code {
+				return err
+			}
+			slog.WarnContext(ctx, "saga step failed, compensating", "err", err)
+			// drop what the failed step changed or issued
+			if rec, err = load(); err != nil {
+				return err
+			}
+			sc = &SagaContext[T]{Key: key, Data: &rec.Data, rec: rec, now: now}
+			sc.Fail(sysErr.Error())
+		}
+		if eventId != "" {
+			rec.Applied = append(rec.Applied, eventId)
+			if len(rec.Applied) > sagaAppliedMax {
+				rec.Applied = rec.Applied[len(rec.Applied)-sagaAppliedMax:]
+			}
+		}
+		rec.Updated = now
+		return store.save(ctx, rec, sc.sent)
+	})
+}
+
+// runTimeouts fires the expired timeouts until ctx is done, a fired instance is leased so one instance
+// of the service handles it
+func (s *Saga[T]) runTimeouts(ctx context.Context, store mongoSagaStore[T]) {
+	ticker := time.NewTicker(sagaTimeoutPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for ctx.Err() == nil {
+			now := time.Now()
+			var rec struct {
+				Key string `bson:"key"`
+			}
+			err := DB.GetCollection(nues.colSagas).FindOneAndUpdate(ctx,
+				bson.M{"saga": s.Name, "status": SagaRunning, "deadline": bson.M{"$lte": now}},
+				bson.M{"$set": bson.M{"deadline": now.Add(sagaTimeoutLease)}},
+			).Decode(&rec)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				break
+			}
+			if err != nil {
+				slog.Error("saga timeouts failed", "saga", s.Name, "err", err)
+				break
+			}
+			if err := s.handleTimeout(ctx, store, rec.Key); err != nil {
+				slog.Error("saga timeout failed", "saga", s.Name, "key", rec.Key, "err", err)
+			}
+		}
+	}
+}
+
+// sagaStore persists saga instances, the harness replaces mongo with memory
+type sagaStore[T any] interface {
+	transact(ctx context.Context, fn func(context.Context) error) error
+	load(ctx context.Context, id string) (*sagaRecord[T], error)
+	save(ctx context.Context, rec *sagaRecord[T], sent []SagaCommand) error
+	now() time.Time
+}
+
+type mongoSagaStore[T any] struct{}
+
+func (mongoSagaStore[T]) transact(ctx context.Context, fn func(context.Context) error) error {
+	session, err := DB.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.WithoutCancel(ctx))
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (any, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+func (mongoSagaStore[T]) load(ctx context.Context, id string) (*sagaRecord[T], error) {
+	rec := &sagaRecord[T]{}
+	err := DB.GetCollection(nues.colSagas).FindOne(ctx, bson.M{"_id": id}).Decode(rec)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	return rec, err
+}
+
+// save writes the instance if nobody changed it since load and enqueues the commands in the same transaction
+func (mongoSagaStore[T]) save(ctx context.Context, rec *sagaRecord[T], sent []SagaCommand) error {
+	col := DB.GetCollection(nues.colSagas)
+	version := rec.Version
+	rec.Version++
+	if version == 0 {
+		if _, err := col.InsertOne(ctx, rec); err != nil {
+			return err
+		}
+	} else {
+		res, err := col.ReplaceOne(ctx, bson.M{"_id": rec.Id, "version": version}, rec)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return ErrSystemInternal
+		}
+	}
+	for _, cmd := range sent {
+		if _, err := Enqueue(ctx, cmd.Service, cmd.Route, json.RawMessage(cmd.Payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mongoSagaStore[T]) now() time.Time {
+	return time.Now()
+}
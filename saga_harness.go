@@ -0,0 +1,144 @@
+package nues
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// SagaHarness runs a saga in memory for tests: events are fed by hand, time is advanced by hand
+// and the commands the saga issues are collected instead of being delivered.
+type SagaHarness[T any] struct {
+	saga  *Saga[T]
+	store *memorySagaStore[T]
+	seq   int64
+}
+
+func NewSagaHarness[T any](saga *Saga[T]) *SagaHarness[T] {
+	return &SagaHarness[T]{
+		saga: saga,
+		store: &memorySagaStore[T]{
+			records: map[string][]byte{},
+			clock:   time.Now().Truncate(time.Millisecond),
+		},
+	}
+}
+
+// Feed delivers data to the saga as the event named after its type, like RegisterEvents names it
+func (h *SagaHarness[T]) Feed(ctx context.Context, data any) error {
+	payload, err := ParseM(data)
+	if err != nil {
+		return err
+	}
+	h.seq++
+	return h.FeedEvent(ctx, Event{
+		Id:        GenerateId(),
+		Name:      typeName(data),
+		Sequence:  h.seq,
+		Timestamp: h.store.clock,
+		Data:      payload,
+	})
+}
+
+// FeedEvent delivers ev as is, feeding the same event twice checks the saga ignores redeliveries
+func (h *SagaHarness[T]) FeedEvent(ctx context.Context, ev Event) error {
+	return h.saga.handleEvent(ctx, h.store, ev)
+}
+
+// Advance moves the clock by d and fires the timeouts expired meanwhile, earliest first
+func (h *SagaHarness[T]) Advance(ctx context.Context, d time.Duration) error {
+	h.store.clock = h.store.clock.Add(d)
+	due := []*sagaRecord[T]{}
+	for id := range h.store.records {
+		rec, err := h.store.load(ctx, id)
+		if err != nil {
+			return err
+		}
+		if rec.Status == SagaRunning && rec.Deadline != nil && !rec.Deadline.After(h.store.clock) {
+			due = append(due, rec)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Deadline.Before(*due[j].Deadline)
+	})
+	for _, rec := range due {
+		if err := h.saga.handleTimeout(ctx, h.store, rec.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// State returns the data and status of the instance of key, false when it does not exist
+func (h *SagaHarness[T]) State(key string) (T, string, bool) {
+	rec, _ := h.store.load(context.Background(), h.saga.Name+":"+key)
+	if rec == nil {
+		var zero T
+		return zero, "", false
+	}
+	return rec.Data, rec.Status, true
+}
+
+// Sent returns the commands issued since the last Sent or ExpectSent call and forgets them
+func (h *SagaHarness[T]) Sent() []SagaCommand {
+	sent := h.store.sent
+	h.store.sent = nil
+	return sent
+}
+
+// ExpectSent checks the routes of the commands issued since the last call, in order
+func (h *SagaHarness[T]) ExpectSent(routes ...string) error {
+	sent := h.Sent()
+	got := make([]string, len(sent))
+	for i, cmd := range sent {
+		got[i] = cmd.Route
+	}
+	if !slices.Equal(got, routes) {
+		return fmt.Errorf("saga %s sent [%s], expected [%s]", h.saga.Name, strings.Join(got, ", "), strings.Join(routes, ", "))
+	}
+	return nil
+}
+
+// memorySagaStore keeps the records marshalled so the state goes through bson like in mongo
+type memorySagaStore[T any] struct {
+	records map[string][]byte
+	sent    []SagaCommand
+	clock   time.Time
+}
+
+// transact has nothing to roll back, save is the last thing a step does
+func (m *memorySagaStore[T]) transact(ctx context.Context, fn func(context.Context) error) error {
+	return fn(ctx)
+}
+
+func (m *memorySagaStore[T]) load(ctx context.Context, id string) (*sagaRecord[T], error) {
+	b, found := m.records[id]
+	if !found {
+		return nil, nil
+	}
+	rec := &sagaRecord[T]{}
+	if err := bson.Unmarshal(b, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (m *memorySagaStore[T]) save(ctx context.Context, rec *sagaRecord[T], sent []SagaCommand) error {
+	rec.Version++
+	b, err := bson.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	m.records[rec.Id] = b
+	m.sent = append(m.sent, sent...)
+	return nil
+}
+
+func (m *memorySagaStore[T]) now() time.Time {
+	return m.clock
+}
@@ -0,0 +1,311 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type EvTestOrderPlaced struct {
+	OrderId string `bson:"order_id"`
+	Amount  int    `bson:"amount"`
+}
+
+type EvTestOrderPaid struct {
+	OrderId string `bson:"order_id"`
+}
+
+type EvTestOrderRejected struct {
+	OrderId string `bson:"order_id"`
+}
+
+type EvTestOrderNoted struct {
+	OrderId string `bson:"order_id"`
+}
+
+type testOrderSaga struct {
+	Amount int    `bson:"amount"`
+	State  string `bson:"state"`
+	Notes  int    `bson:"notes"`
+}
+
+func testOrderKey(ev Event) string {
+	key, _ := decodeEventData[EvTestOrderPaid](ev.Data)
+	return key.OrderId
+}
+
+// newTestOrderSaga charges a placed order and ships it once paid, an order left unpaid for a minute
+// or rejected is refunded
+func newTestOrderSaga() *Saga[testOrderSaga] {
+	return NewSaga[testOrderSaga]("orders").
+		StartOn("EvTestOrderPlaced", testOrderKey, func(ctx context.Context, sc *SagaContext[testOrderSaga], ev Event) error {
+			placed, err := decodeEventData[EvTestOrderPlaced](ev.Data)
+			if err != nil {
+				return err
+			}
+			sc.Data.Amount = placed.Amount
+			sc.Data.State = "charging"
+			if err := sc.Call("billing", "bill_charge", placed); err != nil {
+				return err
+			}
+			if err := sc.Compensate("billing", "bill_refund", placed); err != nil {
+				return err
+			}
+			sc.Timeout(time.Minute)
+			return nil
+		}).
+		On("EvTestOrderPaid", testOrderKey, func(ctx context.Context, sc *SagaContext[testOrderSaga], ev Event) error {
+			sc.Data.State = "shipping"
+			if err := sc.Call("shipping", "ship_order", map[string]any{"order_id": sc.Key}); err != nil {
+				return err
+			}
+			sc.Complete()
+			return nil
+		}).
+		On("EvTestOrderRejected", testOrderKey, func(ctx context.Context, sc *SagaContext[testOrderSaga], ev Event) error {
+			sc.Data.State = "rejected"
+			if err := sc.Call("billing", "bill_audit", map[string]any{"order_id": sc.Key}); err != nil {
+				return err
+			}
+			return ErrBadCommand
+		}).
+		On("EvTestOrderNoted", testOrderKey, func(ctx context.Context, sc *SagaContext[testOrderSaga], ev Event) error {
+			sc.Data.Notes++
+			return nil
+		})
+}
+
+func expectSent(t *testing.T, h *SagaHarness[testOrderSaga], routes ...string) {
+	t.Helper()
+	if err := h.ExpectSent(routes...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectStatus(t *testing.T, h *SagaHarness[testOrderSaga], key, status string) testOrderSaga {
+	t.Helper()
+	data, got, found := h.State(key)
+	if !found {
+		t.Fatalf("no saga instance for %s", key)
+	}
+	if got != status {
+		t.Fatalf("saga %s is %s, want %s", key, got, status)
+	}
+	return data
+}
+
+func TestSagaCompletes(t *testing.T) {
+	ctx := context.Background()
+	h := NewSagaHarness(newTestOrderSaga())
+
+	if err := h.Feed(ctx, EvTestOrderPlaced{OrderId: "o1", Amount: 30}); err != nil {
+		t.Fatal(err)
+	}
+	sent := h.Sent()
+	if len(sent) != 1 || sent[0].Service != "billing" || sent[0].Route != "bill_charge" {
+		t.Fatalf("sent %v", sent)
+	}
+	var charged EvTestOrderPlaced
+	if err := sent[0].Decode(&charged); err != nil || charged.Amount != 30 {
+		t.Fatalf("charged %+v, err %v", charged, err)
+	}
+	if data := expectStatus(t, h, "o1", SagaRunning); data.Amount != 30 || data.State != "charging" {
+		t.Fatalf("state %+v", data)
+	}
+
+	if err := h.Feed(ctx, EvTestOrderPaid{OrderId: "o1"}); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h, "ship_order")
+	if data := expectStatus(t, h, "o1", SagaCompleted); data.State != "shipping" {
+		t.Fatalf("state %+v", data)
+	}
+
+	// the timeout was cancelled and a completed saga ignores later events
+	if err := h.Advance(ctx, 2*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Feed(ctx, EvTestOrderRejected{OrderId: "o1"}); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h)
+	expectStatus(t, h, "o1", SagaCompleted)
+}
+
+func TestSagaTimeoutCompensates(t *testing.T) {
+	ctx := context.Background()
+	h := NewSagaHarness(newTestOrderSaga())
+
+	if err := h.Feed(ctx, EvTestOrderPlaced{OrderId: "o1", Amount: 30}); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h, "bill_charge")
+	if err := h.Advance(ctx, 59*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h)
+	expectStatus(t, h, "o1", SagaRunning)
+
+	if err := h.Advance(ctx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h, "bill_refund")
+	expectStatus(t, h, "o1", SagaCompensated)
+
+	// fired once
+	if err := h.Advance(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h)
+}
+
+func TestSagaTimeoutHandler(t *testing.T) {
+	ctx := context.Background()
+	saga := newTestOrderSaga()
+	saga.OnTimeout = func(ctx context.Context, sc *SagaContext[testOrderSaga]) error {
+		sc.Data.State = "reminded"
+		return sc.Call("billing", "bill_remind", map[string]any{"order_id": sc.Key})
+	}
+	h := NewSagaHarness(saga)
+
+	if err := h.Feed(ctx, EvTestOrderPlaced{OrderId: "o1", Amount: 30}); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h, "bill_charge")
+	if err := h.Advance(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h, "bill_remind")
+	if data := expectStatus(t, h, "o1", SagaRunning); data.State != "reminded" {
+		t.Fatalf("state %+v", data)
+	}
+}
+
+func TestSagaFailedStepCompensates(t *testing.T) {
+	ctx := context.Background()
+	h := NewSagaHarness(newTestOrderSaga())
+
+	for _, id := range []string{"o1", "o2"} {
+		if err := h.Feed(ctx, EvTestOrderPlaced{OrderId: id, Amount: 30}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectSent(t, h, "bill_charge", "bill_charge")
+
+	if err := h.Feed(ctx, EvTestOrderRejected{OrderId: "o1"}); err != nil {
+		t.Fatal(err)
+	}
+	// what the failed step changed and issued is dropped, only the compensation is sent
+	expectSent(t, h, "bill_refund")
+	if data := expectStatus(t, h, "o1", SagaCompensated); data.State != "charging" {
+		t.Fatalf("state %+v", data)
+	}
+	expectStatus(t, h, "o2", SagaRunning)
+}
+
+func TestSagaDurableState(t *testing.T) {
+	ctx := context.Background()
+	h := NewSagaHarness(newTestOrderSaga())
+
+	// events without instance are ignored
+	if err := h.Feed(ctx, EvTestOrderPaid{OrderId: "o1"}); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h)
+	if _, _, found := h.State("o1"); found {
+		t.Fatal("saga instance created by a non starting event")
+	}
+
+	if err := h.Feed(ctx, EvTestOrderPlaced{OrderId: "o1", Amount: 30}); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h, "bill_charge")
+	noted, err := ParseM(EvTestOrderNoted{OrderId: "o1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := Event{Id: GenerateId(), Name: "EvTestOrderNoted", Data: noted}
+	for i := 0; i < 2; i++ {
+		if err := h.FeedEvent(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the state is saved between events and the redelivery is ignored
+	if data := expectStatus(t, h, "o1", SagaRunning); data.Notes != 1 || data.Amount != 30 {
+		t.Fatalf("state %+v", data)
+	}
+
+	// the compensation registered by the first step is still known
+	if err := h.Advance(ctx, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expectSent(t, h, "bill_refund")
+}
+
+func TestSagaAppliedCapped(t *testing.T) {
+	ctx := context.Background()
+	h := NewSagaHarness(newTestOrderSaga())
+
+	if err := h.Feed(ctx, EvTestOrderPlaced{OrderId: "o1", Amount: 30}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < sagaAppliedMax+10; i++ {
+		if err := h.Feed(ctx, EvTestOrderNoted{OrderId: "o1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec, err := h.store.load(ctx, "orders:o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Applied) != sagaAppliedMax {
+		t.Fatalf("%d applied event ids kept", len(rec.Applied))
+	}
+	if rec.Data.Notes != sagaAppliedMax+10 {
+		t.Fatalf("%d notes", rec.Data.Notes)
+	}
+}
+
+// TestSagaWatchesInOrder runs the saga on registered events, the steps registered together reach the
+// instance in order and a step failing for a while is handled again
+func TestSagaWatchesInOrder(t *testing.T) {
+	setupTestDB(t, "orders", Routes{})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	saga := newTestOrderSaga()
+	failures := 0
+	noted := saga.steps["EvTestOrderNoted"]
+	saga.On("EvTestOrderNoted", testOrderKey, func(ctx context.Context, sc *SagaContext[testOrderSaga], ev Event) error {
+		if failures < 2 {
+			failures++
+			return errors.New("unavailable")
+		}
+		return noted.handle(ctx, sc, ev)
+	})
+	if err := saga.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err := RegisterEvents(ctx, EvTestOrderPlaced{OrderId: "o1", Amount: 30}, EvTestOrderNoted{OrderId: "o1"}, EvTestOrderPaid{OrderId: "o1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := sagaRecord[testOrderSaga]{}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		err := DB.GetCollection(nues.colSagas).FindOne(ctx, bson.M{"_id": "orders:o1"}).Decode(&rec)
+		if err == nil && rec.Status != SagaRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("saga not completed: %+v, err %v", rec, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if rec.Status != SagaCompleted || rec.Data.Notes != 1 || rec.Data.State != "shipping" || len(rec.Applied) != 3 {
+		t.Fatalf("saga ended %+v", rec)
+	}
+}
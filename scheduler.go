@@ -0,0 +1,349 @@
+package nues
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	JobScheduled = "scheduled"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+
+	schedulerPollInterval = time.Second
+	// jobLease hides a claimed job from the other replicas, see jobLeaseTime
+	jobLease              = 2 * time.Minute
+	defaultJobMaxAttempts = 5
+	defaultJobsLimit      = 100
+)
+
+// Job runs a COMMAND route of this service at RunAt, cron jobs are moved to their next occurrence after each run
+type Job struct {
+	Id      string    `bson:"_id" json:"id"`
+	Route   string    `bson:"route" json:"route"`
+	Payload string    `bson:"payload" json:"payload"`
+	Cron    string    `bson:"cron,omitempty" json:"cron,omitempty"`
+	RunAt   time.Time `bson:"run_at" json:"run_at"`
+	Status  string    `bson:"status" json:"status"`
+	// Attempts counts the tries of the current occurrence
+	Attempts    int        `bson:"attempts" json:"attempts"`
+	LockedUntil time.Time  `bson:"locked_until" json:"locked_until"`
+	Runs        int64      `bson:"runs" json:"runs"`
+	LastRun     *time.Time `bson:"last_run,omitempty" json:"last_run,omitempty"`
+	LastError   string     `bson:"last_error,omitempty" json:"last_error,omitempty"`
+	Created     time.Time  `bson:"created" json:"created"`
+}
+
+// callId is the same for every try of an occurrence, a command that ran but was not recorded is not run twice
+func (j Job) callId() string {
+	return j.Id + "@" + strconv.FormatInt(j.RunAt.UnixMilli(), 10)
+}
+
+// Schedule runs the COMMAND route once at runAt and returns the job id.
+// Called with the context given to Command.Handle the job is created with the command.
+func Schedule(ctx context.Context, route string, runAt time.Time, payload any) (string, error) {
+	payloadB, err := jobPayload(route, payload)
+	if err != nil {
+		return "", err
+	}
+	job := Job{
+		Id:      GenerateId(),
+		Route:   route,
+		Payload: payloadB,
+		RunAt:   runAt,
+		Status:  JobScheduled,
+		Created: time.Now(),
+	}
+	if _, err := DB.GetCollection(nues.colJobs).InsertOne(ctx, job); err != nil {
+		slog.ErrorContext(ctx, "job schedule failed", "err", err)
+		return "", ErrSystemInternal
+	}
+	return job.Id, nil
+}
+
+// ScheduleCron runs the COMMAND route on every occurrence of the standard cron expression.
+// The job is keyed by id so it can be declared at every start, it is only reset when it changed.
+func ScheduleCron(ctx context.Context, id, route, expr string, payload any) error {
+	if id == "" {
+		return NewError(-1, "job id is required")
+	}
+	schedule, err := cron.ParseStandard(expr)
+	if err != nil {
+		return NewError(-1, fmt.Sprintf("invalid cron expression: %s", err))
+	}
+	payloadB, err := jobPayload(route, payload)
+	if err != nil {
+		return err
+	}
+	col := DB.GetCollection(nues.colJobs)
+	var existing Job
+	err = col.FindOne(ctx, bson.M{"_id": id}).Decode(&existing)
+	if err == nil && existing.Status == JobScheduled && existing.Cron == expr && existing.Route == route && existing.Payload == payloadB {
+		return nil
+	}
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		slog.ErrorContext(ctx, "job lookup failed", "err", err)
+		return ErrSystemInternal
+	}
+	now := time.Now()
+	job := Job{
+		Id:      id,
+		Route:   route,
+		Payload: payloadB,
+		Cron:    expr,
+		RunAt:   schedule.Next(now),
+		Status:  JobScheduled,
+		Created: now,
+	}
+	if _, err := col.ReplaceOne(ctx, bson.M{"_id": id}, job, options.Replace().SetUpsert(true)); err != nil {
+		slog.ErrorContext(ctx, "job schedule failed", "err", err)
+		return ErrSystemInternal
+	}
+	return nil
+}
+
+// CancelJob stops a scheduled job, ErrJobNotFound when it is not scheduled anymore
+func CancelJob(ctx context.Context, id string) error {
+	res, err := DB.GetCollection(nues.colJobs).UpdateOne(ctx, bson.M{"_id": id, "status": JobScheduled},
+		bson.M{"$set": bson.M{"status": JobCancelled}})
+	if err != nil {
+		slog.ErrorContext(ctx, "job cancel failed", "err", err)
+		return ErrSystemInternal
+	}
+	if res.MatchedCount == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+// ListJobs returns the jobs with status, all of them when status is empty, next to run first
+func ListJobs(ctx context.Context, status string, limit int64) ([]Job, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	if limit <= 0 {
+		limit = defaultJobsLimit
+	}
+	cur, err := DB.GetCollection(nues.colJobs).Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "run_at", Value: 1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	jobs := []Job{}
+	err = cur.All(ctx, &jobs)
+	return jobs, err
+}
+
+func jobPayload(route string, payload any) (string, error) {
+	r, found := nues.Routes[route]
+	if !found || r.Call != COMMAND {
+		return "", ErrBadCommand
+	}
+	payloadB, err := json.Marshal(payload)
+	if err != nil {
+		return "", ErrBadCommand
+	}
+	return string(payloadB), nil
+}
+
+func initJobsIndex(ctx context.Context) error {
+	_, err := DB.GetCollection(nues.colJobs).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "run_at", Value: 1}, {Key: "locked_until", Value: 1}},
+	})
+	return err
+}
+
+// runScheduler executes the due jobs until ctx is done, each replica runs it and a claimed job
+// is locked to one of them
+func runScheduler(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(schedulerPollInterval)
+		defer ticker.Stop()
+		for {
+			for ctx.Err() == nil {
+				found, err := runNextJob(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						slog.Error("scheduler failed", "err", err)
+					}
+					break
+				}
+				if !found {
+					break
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// jobLeaseTime outlasts the timeout of every COMMAND route, a job is not claimed again while its command runs
+func jobLeaseTime() time.Duration {
+	lease := jobLease
+	for _, route := range nues.Routes {
+		if route.Call == COMMAND {
+			lease = max(lease, route.timeout()+apiTimeoutMargin)
+		}
+	}
+	return lease
+}
+
+func runNextJob(ctx context.Context) (bool, error) {
+	now := time.Now()
+	var job Job
+	err := DB.GetCollection(nues.colJobs).FindOneAndUpdate(ctx,
+		bson.M{"status": JobScheduled, "run_at": bson.M{"$lte": now}, "locked_until": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"locked_until": now.Add(jobLeaseTime())}, "$inc": bson.M{"attempts": 1}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "run_at", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&job)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	runErr := runJob(ctx, job)
+	if ctx.Err() != nil {
+		// shutting down, the lock expires and another replica runs it with the same callId
+		return true, nil
+	}
+	return true, settleJob(context.WithoutCancel(ctx), job, runErr)
+}
+
+func runJob(ctx context.Context, job Job) (err error) {
+	route, found := nues.Routes[job.Route]
+	if !found || route.Call != COMMAND {
+		return ErrBadCommand
+	}
+	ctx, cancel := context.WithTimeout(ctx, route.timeout())
+	defer cancel()
+	ctx, span := startSpan(ctx, "job "+job.Route, trace.SpanKindInternal, attribute.String("nues.job", job.Id))
+	defer func() {
+		endSpan(span, err)
+	}()
+	ctx = WithLogAttrs(ctx, slog.String("job", job.Id), slog.String("route", job.Route), slog.String("call_id", job.callId()))
+
+	res, err := rpcServe(ctx, route, &NuesRpcArgs{
+		CommandName: job.Route,
+		Payload:     json.RawMessage(job.Payload),
+		CallId:      job.callId(),
+	})
+	if err != nil {
+		return err
+	}
+	if cr, ok := res.(*CommandRoot); ok && cr.Error != nil {
+		return cr.Error
+	}
+	return nil
+}
+
+// settleJob records the run, transient failures are retried with backoff on the same occurrence.
+// A command still in progress was started by an earlier try whose lease expired, it is waited for
+// without counting an attempt.
+func settleJob(ctx context.Context, job Job, runErr error) error {
+	now := time.Now()
+	set := bson.M{"last_run": now}
+	var update bson.M
+	var sysErr SysErrorData
+	inProgress := errors.As(runErr, &sysErr) && sysErr.Code == ErrCallInProgress.(SysErrorData).Code
+	final := !inProgress && (runErr == nil || (errors.As(runErr, &sysErr) && isFinalError(ctx, sysErr)) || job.Attempts >= defaultJobMaxAttempts)
+	if runErr != nil {
+		set["last_error"] = runErr.Error()
+	}
+
+	switch {
+	case inProgress:
+		slog.WarnContext(ctx, "job command still in progress, waiting", "job", job.Id, "attempt", job.Attempts)
+		update = bson.M{"$set": bson.M{"locked_until": now.Add(outboxBackoff(job.Attempts))}, "$inc": bson.M{"attempts": -1}}
+	case !final:
+		slog.WarnContext(ctx, "job failed, retrying", "job", job.Id, "attempt", job.Attempts, "err", runErr)
+		update = bson.M{"$set": bson.M{"locked_until": now.Add(outboxBackoff(job.Attempts)), "last_error": runErr.Error()}}
+	case job.Cron != "":
+		if runErr != nil {
+			slog.ErrorContext(ctx, "job failed", "job", job.Id, "err", runErr)
+		}
+		schedule, err := cron.ParseStandard(job.Cron)
+		if err != nil {
+			return err
+		}
+		set["run_at"] = schedule.Next(now)
+		set["attempts"] = 0
+		set["locked_until"] = time.Time{}
+		update = bson.M{"$set": set, "$inc": bson.M{"runs": 1}}
+		if runErr == nil {
+			update["$unset"] = bson.M{"last_error": ""}
+		}
+	case runErr != nil:
+		slog.ErrorContext(ctx, "job failed", "job", job.Id, "err", runErr)
+		set["status"] = JobFailed
+		update = bson.M{"$set": set, "$inc": bson.M{"runs": 1}}
+	default:
+		set["status"] = JobDone
+		update = bson.M{"$set": set, "$inc": bson.M{"runs": 1}}
+	}
+	_, err := DB.GetCollection(nues.colJobs).UpdateOne(ctx, bson.M{"_id": job.Id, "status": JobScheduled}, update)
+	return err
+}
+
+// QryJobs lists the jobs, served by the admin route nues_jobs
+type QryJobs struct {
+	Status string `json:"status"`
+	Limit  int64  `json:"limit"`
+}
+
+func (q *QryJobs) Handle(ctx context.Context) (QueryResponse, error) {
+	jobs, err := ListJobs(ctx, q.Status, q.Limit)
+	if err != nil {
+		slog.ErrorContext(ctx, "jobs list failed", "err", err)
+		return nil, ErrSystemInternal
+	}
+	return QueryResponse{"jobs": jobs}, nil
+}
+
+// CmdCancelJob cancels a job, served by the admin route nues_jobs_cancel
+type CmdCancelJob struct {
+	Id string `validate:"required" json:"id"`
+}
+
+func (c *CmdCancelJob) Handle(ctx context.Context) (CommandResponse, error) {
+	if err := CancelJob(ctx, c.Id); err != nil {
+		return nil, err
+	}
+	return map[string]any{"id": c.Id, "status": JobCancelled}, nil
+}
+
+// schedulerRoutes are the admin routes added to every service
+func schedulerRoutes() Routes {
+	return Routes{
+		"nues_jobs": {
+			Name:    "nues_jobs",
+			Admin:   true,
+			Call:    QUERY,
+			Handler: func() any { return &QryJobs{} },
+		},
+		"nues_jobs_cancel": {
+			Name:    "nues_jobs_cancel",
+			Admin:   true,
+			Call:    COMMAND,
+			Handler: func() any { return &CmdCancelJob{} },
+		},
+	}
+}
@@ -0,0 +1,56 @@
+package nues
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestJobLeaseOutlastsRoutes(t *testing.T) {
+	nues.Routes = Routes{
+		"quick": {Name: "quick", Call: COMMAND},
+		"slow":  {Name: "slow", Call: COMMAND, Timeout: 5 * time.Minute},
+		"read":  {Name: "read", Call: QUERY, Timeout: time.Hour},
+	}
+	t.Cleanup(func() { nues.Routes = nil })
+
+	if got := jobLeaseTime(); got != 5*time.Minute+apiTimeoutMargin {
+		t.Fatalf("jobLeaseTime() = %v", got)
+	}
+	nues.Routes = Routes{"quick": {Name: "quick", Call: COMMAND}}
+	if got := jobLeaseTime(); got != jobLease {
+		t.Fatalf("jobLeaseTime() = %v", got)
+	}
+}
+
+// TestSettleJobInProgress checks a job whose command still runs from an earlier try is waited for
+func TestSettleJobInProgress(t *testing.T) {
+	setupTestDB(t, "jobs", Routes{})
+	ctx := context.Background()
+	col := DB.GetCollection(nues.colJobs)
+
+	runAt := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	for _, job := range []Job{
+		{Id: "once", Route: "bill_pay", RunAt: runAt, Status: JobScheduled, Attempts: defaultJobMaxAttempts},
+		{Id: "nightly", Route: "bill_pay", Cron: "0 3 * * *", RunAt: runAt, Status: JobScheduled, Attempts: 1},
+	} {
+		if _, err := col.InsertOne(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+		if err := settleJob(ctx, job, ErrCallInProgress); err != nil {
+			t.Fatal(err)
+		}
+		var settled Job
+		if err := col.FindOne(ctx, bson.M{"_id": job.Id}).Decode(&settled); err != nil {
+			t.Fatal(err)
+		}
+		if settled.Status != JobScheduled || !settled.RunAt.Equal(runAt) || settled.Attempts != job.Attempts-1 {
+			t.Fatalf("job %s settled as %+v", job.Id, settled)
+		}
+		if !settled.LockedUntil.After(time.Now()) {
+			t.Fatalf("job %s retried without backoff", job.Id)
+		}
+	}
+}
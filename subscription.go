@@ -0,0 +1,411 @@
+package nues
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	subscriptionKeepAlive    = 25 * time.Second
+	subscriptionPollInterval = time.Second
+	subscriptionPollBatch    = 1000
+	// subscriptionCoalesce is the least time between two queries of a subscriber, the events
+	// registered meanwhile are answered by one query
+	subscriptionCoalesce = 250 * time.Millisecond
+)
+
+// SubscriptionFilter is implemented by subscribed queries depending on some of the events of their
+// Subscribe names only, say the ones of one account. A subscriber is only queried again when Affects
+// tells an event may change its result. Affects runs for every subscriber, it must be cheap.
+type SubscriptionFilter interface {
+	Affects(ev Event) bool
+}
+
+// SubscriptionMessage is pushed to a subscriber each time the result of its query changes,
+// Sequence is the last event it reflects and resumes the subscription
+type SubscriptionMessage struct {
+	Sequence int64      `json:"sequence"`
+	Response *QueryRoot `json:"response"`
+}
+
+// subscriptionHub follows the registered events once for the process and wakes the subscribers
+// the events affect
+type subscriptionHub struct {
+	mu      sync.Mutex
+	subs    map[*subscriber]struct{}
+	started bool
+}
+
+var subscriptions = &subscriptionHub{subs: map[*subscriber]struct{}{}}
+
+type subscriber struct {
+	events []string
+	// filter is nil when every event of the names affects the subscriber
+	filter SubscriptionFilter
+	latest atomic.Int64
+	notify chan struct{}
+}
+
+func (h *subscriptionHub) add(events []string, filter SubscriptionFilter) *subscriber {
+	s := &subscriber{events: events, filter: filter, notify: make(chan struct{}, 1)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[s] = struct{}{}
+	if !h.started {
+		h.started = true
+		go h.feed(serviceContext())
+	}
+	return s
+}
+
+func (h *subscriptionHub) remove(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+}
+
+func (h *subscriptionHub) publish(ev Event) {
+	h.mu.Lock()
+	subs := make([]*subscriber, 0, len(h.subs))
+	for s := range h.subs {
+		if slices.Contains(s.events, ev.Name) {
+			subs = append(subs, s)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, s := range subs {
+		if s.filter != nil && !s.filter.Affects(ev) {
+			continue
+		}
+		if ev.Sequence > s.latest.Load() {
+			s.latest.Store(ev.Sequence)
+		}
+		// a subscriber behind on its notifications only needs the latest sequence
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// feed publishes the events as the change stream reports them, polling when streams are not available
+func (h *subscriptionHub) feed(ctx context.Context) {
+	last, err := getLastSeq(ctx, bson.D{})
+	if err != nil {
+		slog.Error("subscription feed failed", "err", err)
+	}
+	st, err := DB.Events().Watch(ctx, mongo.Pipeline{bson.D{{Key: "$match", Value: bson.M{"operationType": "insert"}}}})
+	if err == nil {
+		defer st.Close(context.WithoutCancel(ctx))
+		for st.Next(ctx) {
+			var change struct {
+				FullDocument Event `bson:"fullDocument"`
+			}
+			if err := st.Decode(&change); err != nil {
+				slog.Error("subscription feed decode failed", "err", err)
+				continue
+			}
+			last = max(last, change.FullDocument.Sequence)
+			h.publish(change.FullDocument)
+		}
+		err = st.Err()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	slog.Warn("subscription change stream unavailable, polling", "err", err)
+
+	ticker := time.NewTicker(subscriptionPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cur, err := DB.Events().Find(ctx, bson.M{"sequence": bson.M{"$gt": last}},
+			options.Find().SetSort(bson.D{{Key: "sequence", Value: 1}}).SetLimit(subscriptionPollBatch))
+		if err != nil {
+			slog.Error("subscription poll failed", "err", err)
+			continue
+		}
+		events := []Event{}
+		if err := cur.All(ctx, &events); err != nil {
+			slog.Error("subscription poll failed", "err", err)
+			continue
+		}
+		for _, ev := range events {
+			last = ev.Sequence
+			h.publish(ev)
+		}
+	}
+}
+
+// subscriptionSink is the transport pushing messages to a subscriber
+type subscriptionSink interface {
+	send(seq int64, msg []byte) error
+	keepAlive() error
+}
+
+type sseSink struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (s sseSink) send(seq int64, msg []byte) error {
+	if _, err := fmt.Fprintf(s.w, "id: %d\nevent: update\ndata: %s\n\n", seq, msg); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+func (s sseSink) keepAlive() error {
+	if _, err := io.WriteString(s.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+type wsSink struct {
+	ws *websocket.Conn
+}
+
+func (s wsSink) send(seq int64, msg []byte) error {
+	return websocket.Message.Send(s.ws, string(msg))
+}
+
+func (s wsSink) keepAlive() error {
+	return websocket.Message.Send(s.ws, `{"keep_alive":true}`)
+}
+
+// subscribe serves /subscribe/<route>: a QUERY route declaring the events it depends on, see Route.Subscribe.
+// Its payload is the payload URL parameter, or the body of a POST over SSE. The result is pushed at start
+// and each time one of the events changes it, over WebSocket when asked for an upgrade, SSE otherwise.
+// A subscriber resumes with the last sequence it saw, the Last-Event-ID header or the last_sequence
+// URL parameter, it then only gets a message when something happened since. The session is checked
+// again at every keep-alive, the subscription ends once it is no longer valid.
+func (h *NuesApi) subscribe(w http.ResponseWriter, r *http.Request) {
+	path, _ := strings.CutPrefix(r.URL.Path, "/subscribe/")
+	route, found := nues.Routes[path]
+	if !found || route.Call != QUERY || len(route.Subscribe) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx = WithLogAttrs(ctx, slog.String("route", route.Name))
+
+	if !allowedOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	token := subscriptionToken(r)
+	if !authCall(ctx, token, route) {
+		observeCall("subscription", route, time.Now(), nil, ErrUserNotAuth)
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	payload := []byte(r.URL.Query().Get("payload"))
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "can't read your request!", http.StatusBadRequest)
+			return
+		}
+		payload = body
+	}
+	root, err := newQueryRoot(route, payload)
+	if err != nil {
+		http.Error(w, "can't read your request!", http.StatusBadRequest)
+		return
+	}
+	filter, _ := root.Query.(SubscriptionFilter)
+	lastSeq, err := subscriptionLastSequence(r)
+	if err != nil {
+		http.Error(w, "can't read your request!", http.StatusBadRequest)
+		return
+	}
+	slog.InfoContext(ctx, "subscription started", "last_sequence", lastSeq)
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{Handshake: func(_ *websocket.Config, r *http.Request) error {
+			// browsers send the token cookie from any page, the origin tells which page opened the socket
+			if !allowedOrigin(r) {
+				return ErrUserNotAuth
+			}
+			return nil
+		}, Handler: func(ws *websocket.Conn) {
+			// the API server deadlines apply to calls, not to a subscription
+			ws.SetDeadline(time.Time{})
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go func() {
+				// the client does not talk, reading only tells when it leaves
+				var discard string
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+				cancel()
+			}()
+			serveSubscription(ctx, route, token, payload, filter, lastSeq, wsSink{ws: ws})
+		}}.ServeHTTP(w, r)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	// the API server deadlines apply to calls, past the read one the request context is cancelled
+	if err := errors.Join(rc.SetReadDeadline(time.Time{}), rc.SetWriteDeadline(time.Time{})); err != nil {
+		slog.WarnContext(ctx, "subscription deadlines not cleared", "err", err)
+	}
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	serveSubscription(ctx, route, token, payload, filter, lastSeq, sseSink{w: w, rc: rc})
+}
+
+func serveSubscription(ctx context.Context, route Route, token string, payload []byte, filter SubscriptionFilter, lastSeq int64, sink subscriptionSink) {
+	sub := subscriptions.add(route.Subscribe, filter)
+	defer subscriptions.remove(sub)
+
+	var lastSent []byte
+	var pushed time.Time
+	push := func(seq int64) error {
+		start := time.Now()
+		pushed = start
+		root, err := newQueryRoot(route, payload)
+		if err != nil {
+			return err
+		}
+		qctx, cancel := context.WithTimeout(WithMinSequence(ctx, seq), route.timeout())
+		root.Execute(qctx)
+		cancel()
+		observeCall("subscription", route, start, root, nil)
+		response, err := json.Marshal(root.Response)
+		if err != nil {
+			return err
+		}
+		if root.Error == nil && bytes.Equal(response, lastSent) {
+			return nil
+		}
+		lastSent = response
+		msg, err := json.Marshal(SubscriptionMessage{Sequence: seq, Response: root})
+		if err != nil {
+			return err
+		}
+		return sink.send(seq, msg)
+	}
+
+	current, err := getLastSeq(ctx, buildStreamQuery(route.Subscribe))
+	if err != nil {
+		slog.ErrorContext(ctx, "subscription failed", "err", err)
+		return
+	}
+	if lastSeq == 0 || current > lastSeq {
+		if err := push(current); err != nil {
+			slog.InfoContext(ctx, "subscription ended", "err", err)
+			return
+		}
+	}
+
+	ticker := time.NewTicker(subscriptionKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			slog.InfoContext(ctx, "subscription ended")
+			return
+		case <-sub.notify:
+			if wait := time.Until(pushed.Add(subscriptionCoalesce)); wait > 0 {
+				select {
+				case <-ctx.Done():
+					continue
+				case <-time.After(wait):
+				}
+				// the events notified while waiting are answered by this query
+				select {
+				case <-sub.notify:
+				default:
+				}
+			}
+			err = push(sub.latest.Load())
+		case <-ticker.C:
+			// a logout or an expired session ends the subscription
+			if !authCall(ctx, token, route) {
+				err = ErrUserNotAuth
+				break
+			}
+			err = sink.keepAlive()
+		}
+		if err != nil {
+			slog.InfoContext(ctx, "subscription ended", "err", err)
+			return
+		}
+	}
+}
+
+// newQueryRoot decodes payload into a new query of route
+func newQueryRoot(route Route, payload []byte) (*QueryRoot, error) {
+	queryClone := route.Handler()
+	query, ok := queryClone.(Query)
+	if !ok {
+		return nil, ErrSystemInternal
+	}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, queryClone); err != nil {
+			return nil, ErrBadCommand
+		}
+	}
+	return &QueryRoot{Query: query}, nil
+}
+
+// subscriptionToken reads the token cookie or header like API calls, browsers can't set headers
+// on EventSource and WebSocket so they rely on the cookie
+func subscriptionToken(r *http.Request) string {
+	if cookie, _ := r.Cookie("token"); cookie != nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	return r.Header.Get("token")
+}
+
+// allowedOrigin tells if the page opening a subscription may use the credentials of the browser:
+// the API host itself or one of Nues.AllowedOrigins. Clients other than browsers send no Origin.
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host || slices.Contains(nues.AllowedOrigins, origin)
+}
+
+func subscriptionLastSequence(r *http.Request) (int64, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_sequence")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
@@ -0,0 +1,95 @@
+package nues
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type testAccountFilter struct {
+	Account string `bson:"account" json:"account"`
+}
+
+func (f testAccountFilter) Affects(ev Event) bool {
+	data, err := decodeEventData[testAccountFilter](ev.Data)
+	return err == nil && data.Account == f.Account
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	nues.AllowedOrigins = []string{"https://app.example.com"}
+	t.Cleanup(func() { nues.AllowedOrigins = nil })
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"https://api.example.com", true},
+		{"https://app.example.com", true},
+		{"https://evil.example.net", false},
+		{"https://api.example.com.evil.net", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "https://api.example.com/subscribe/orders", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := allowedOrigin(r); got != tt.want {
+			t.Errorf("allowedOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestSubscriptionTokenIgnoresUrl(t *testing.T) {
+	r := httptest.NewRequest("GET", "/subscribe/orders?token=id:secret", nil)
+	if token := subscriptionToken(r); token != "" {
+		t.Fatalf("token read from the URL: %q", token)
+	}
+	r.Header.Set("token", "id:header")
+	if token := subscriptionToken(r); token != "id:header" {
+		t.Fatalf("token = %q, want the header one", token)
+	}
+}
+
+func TestSubscriptionHubFilters(t *testing.T) {
+	// started keeps the hub from following the events
+	hub := &subscriptionHub{subs: map[*subscriber]struct{}{}, started: true}
+	all := hub.add([]string{"EvTestTransferred"}, nil)
+	mine := hub.add([]string{"EvTestTransferred"}, testAccountFilter{Account: "a1"})
+	other := hub.add([]string{"EvTestOpened"}, nil)
+
+	woken := func(s *subscriber) bool {
+		select {
+		case <-s.notify:
+			return true
+		default:
+			return false
+		}
+	}
+	hub.publish(Event{Name: "EvTestTransferred", Sequence: 3, Data: bson.M{"account": "a2"}})
+	hub.publish(Event{Name: "EvTestTransferred", Sequence: 4, Data: bson.M{"account": "a2"}})
+	if !woken(all) || all.latest.Load() != 4 {
+		t.Fatalf("subscriber of every event at %d", all.latest.Load())
+	}
+	if woken(all) {
+		t.Fatal("wakeups not coalesced")
+	}
+	if woken(mine) || woken(other) {
+		t.Fatal("subscriber woken by an event not affecting it")
+	}
+
+	hub.publish(Event{Name: "EvTestTransferred", Sequence: 5, Data: bson.M{"account": "a1"}})
+	if !woken(mine) || mine.latest.Load() != 5 {
+		t.Fatalf("filtered subscriber at %d", mine.latest.Load())
+	}
+	if !woken(all) {
+		t.Fatal("subscriber of every event not woken")
+	}
+
+	hub.remove(all)
+	hub.publish(Event{Name: "EvTestTransferred", Sequence: 6, Data: bson.M{"account": "a1"}})
+	if woken(all) {
+		t.Fatal("removed subscriber woken")
+	}
+}
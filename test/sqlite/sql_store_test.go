@@ -0,0 +1,126 @@
+// Package sqlite_test runs the SqlStore tests on SQLite. It is a module of its own so the driver
+// stays out of the requirements of nues, run them with go test from this directory.
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ovresko/nues"
+	_ "modernc.org/sqlite"
+)
+
+func newTestSqlStore(t *testing.T) *nues.SqlStore {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "projections.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("CREATE TABLE balances (id TEXT PRIMARY KEY, amount INTEGER NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	return nues.NewSqlStore(db)
+}
+
+func sqlBalance(t *testing.T, s *nues.SqlStore, id string) (int, bool) {
+	t.Helper()
+	var amount int
+	err := s.DB().QueryRow("SELECT amount FROM balances WHERE id = $1", id).Scan(&amount)
+	if err == sql.ErrNoRows {
+		return 0, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return amount, true
+}
+
+func TestSqlStoreTransact(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlStore(t)
+
+	if seq, err := s.Sequence(ctx, "balances"); err != nil || seq != 0 {
+		t.Fatalf("sequence = %d, %v", seq, err)
+	}
+	err := s.Transact(ctx, func(ctx context.Context) error {
+		if _, err := nues.SqlTx(ctx).ExecContext(ctx, "INSERT INTO balances (id, amount) VALUES ($1, $2)", "a", 1); err != nil {
+			return err
+		}
+		return s.Checkpoint(ctx, "balances", 0, 5)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amount, found := sqlBalance(t, s, "a"); !found || amount != 1 {
+		t.Fatalf("a = %d, %v", amount, found)
+	}
+	if seq, _ := s.Sequence(ctx, "balances"); seq != 5 {
+		t.Fatalf("sequence = %d", seq)
+	}
+
+	// the rows of a failed batch roll back with its checkpoint
+	failed := errors.New("failed")
+	err = s.Transact(ctx, func(ctx context.Context) error {
+		if _, err := nues.SqlTx(ctx).ExecContext(ctx, "INSERT INTO balances (id, amount) VALUES ($1, $2)", "b", 2); err != nil {
+			return err
+		}
+		if err := s.Checkpoint(ctx, "balances", 5, 6); err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("err = %v", err)
+	}
+	if _, found := sqlBalance(t, s, "b"); found {
+		t.Fatal("row of a failed batch committed")
+	}
+	if seq, _ := s.Sequence(ctx, "balances"); seq != 5 {
+		t.Fatalf("sequence moved by a failed batch to %d", seq)
+	}
+	if nues.SqlTx(ctx) != nil {
+		t.Fatal("transaction outside of Transact")
+	}
+}
+
+func TestSqlStoreCheckpointAndReset(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSqlStore(t)
+
+	if _, err := s.Sequence(ctx, "balances"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Checkpoint(ctx, "balances", 0, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Checkpoint(ctx, "balances", 0, 4); err != nues.ErrProjectionFailed {
+		t.Fatalf("err = %v, want %v", err, nues.ErrProjectionFailed)
+	}
+	if err := s.Checkpoint(ctx, "unknown", 0, 1); err != nues.ErrProjectionFailed {
+		t.Fatalf("err = %v, want %v", err, nues.ErrProjectionFailed)
+	}
+	if err := s.Reset(ctx, "balances"); err != nil {
+		t.Fatal(err)
+	}
+	if seq, _ := s.Sequence(ctx, "balances"); seq != 0 {
+		t.Fatalf("sequence = %d after reset", seq)
+	}
+}
+
+func TestSqlStoreInitRetried(t *testing.T) {
+	s := newTestSqlStore(t)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Sequence(cancelled, "balances"); err == nil {
+		t.Fatal("checkpoint table created with a cancelled context")
+	}
+	// the failure of the first call is not kept
+	if seq, err := s.Sequence(context.Background(), "balances"); err != nil || seq != 0 {
+		t.Fatalf("sequence = %d, %v", seq, err)
+	}
+}
@@ -10,6 +10,10 @@ type ConfigNues struct {
 	ColSessions    string `json:"col_sessions" bson:"col_sessions"`
 	ColIdentity    string `json:"col_identity" bson:"col_identity"`
 	ColProjections string `json:"col_projections" bson:"col_projections"`
+	ColOutbox      string `json:"col_outbox" bson:"col_outbox"`
+	ColSagas       string `json:"col_sagas" bson:"col_sagas"`
+	ColJobs        string `json:"col_jobs" bson:"col_jobs"`
+	ColDeadLetters string `json:"col_dead_letters" bson:"col_dead_letters"`
 	DbPrefix       string `json:"db_prefix" bson:"db_prefix"`
 }
 
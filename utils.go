@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -42,6 +43,15 @@ func CleanPhoneNumber(rawNumber string) (string, error) {
 	return "", ErrPhoneBadFormat
 }
 
+// typeName returns the name of the type of v, dereferencing pointers
+func typeName(v any) string {
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
 func GenerateId() string {
 	id := uuid.NewString()
 	id = strings.ReplaceAll(id, "-", "")
@@ -159,7 +169,7 @@ func ToFloat64(x interface{}) (float64, error) {
 	case string:
 		z, err := strconv.ParseFloat(v, 64)
 		if err != nil {
-			slog.Error("tofloat failed", err)
+			slog.Error("tofloat failed", "err", err)
 			return 0, err
 		}
 		y = z
@@ -189,7 +199,7 @@ func ToFloat64(x interface{}) (float64, error) {
 	case float64:
 		y = v
 	default:
-		slog.Error("", ErrParsingData)
+		slog.Error("tofloat failed", "err", ErrParsingData)
 		return 0, ErrParsingData
 	}
 
@@ -209,7 +219,7 @@ func GetClientIpAddr(r *http.Request) string {
 	return ip
 }
 
-func identityValidator(fl validator.FieldLevel) bool {
+func identityValidator(ctx context.Context, fl validator.FieldLevel) bool {
 
 	if !fl.Field().IsValid() {
 		return false
@@ -219,7 +229,7 @@ func identityValidator(fl validator.FieldLevel) bool {
 	if id == "" {
 		return false
 	}
-	res, err := DB.GetCollection(nues.colIdentity).CountDocuments(context.TODO(), bson.M{"_id": id})
+	res, err := DB.GetCollection(nues.colIdentity).CountDocuments(ctx, bson.M{"_id": id})
 	if err != nil {
 		return false
 	}
@@ -0,0 +1,564 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	watcherBackoffBase = 500 * time.Millisecond
+	watcherBackoffMax  = 30 * time.Second
+	// watcherLeaseTTL is how long a replica keeps a watcher without renewing its lease
+	watcherLeaseTTL = 30 * time.Second
+	// watcherQueueSize is how many events wait per worker before the stream is paused
+	watcherQueueSize = 64
+)
+
+// change stream errors telling the resume token can't be used anymore, it fell off the oplog
+var resumeLostCodes = []int{
+	260, // InvalidResumeToken
+	280, // ChangeStreamFatalError
+	286, // ChangeStreamHistoryLost
+}
+
+var (
+	// errResumeLost restarts a watcher from its sequence right away
+	errResumeLost = errors.New("watcher resume token lost")
+	// errWatcherPositionLost stops a watcher which can neither resume nor catch up
+	errWatcherPositionLost = errors.New("watcher resume token lost without sequence")
+	// errWatcherLeaseLost stops a watcher another replica took over
+	errWatcherLeaseLost = errors.New("watcher lease lost")
+)
+
+// WatchOptions tunes how the events of a watcher are processed
+type WatchOptions struct {
+	// Group names the consumer group, defaults to the event name. Replicas watching with the same group
+	// compete for it: one of them holds its lease and processes the events, another takes over when it stops.
+	Group string
+	// Parallelism is how many events are processed at once, defaults to 1
+	Parallelism int
+	// Key returns the stream id of an event, the events of a stream are processed in order.
+	// Without Key, events processed in parallel have no order.
+	Key func(Event) string
+}
+
+// watcherDoc is the position of a watcher, the change stream resume token and the sequence
+// of the last event it processed, and the replica holding its lease
+type watcherDoc struct {
+	Id    string `bson:"_id"`
+	Event string `bson:"event,omitempty"`
+	// Events are the names followed by a watcher of several events
+	Events   []string `bson:"events,omitempty"`
+	Resume   any      `bson:"resume"`
+	Sequence *int64   `bson:"sequence"`
+}
+
+// watcher runs a callback on every new event of some names, see Database.WatchEventsWith
+type watcher struct {
+	id     string
+	events []string
+	// runner holds the lease for this watcher, two watchers of a process never share it
+	runner   string
+	opts     WatchOptions
+	callback func(context.Context, Event) error
+}
+
+func (d *Database) WatchEvents(eventName string, callback func(context.Context, Event) error) error {
+	return d.WatchEventsCtx(serviceContext(), eventName, callback)
+}
+
+// WatchEventsCtx runs callback on every new eventName event until ctx is done, see WatchEventsWith
+func (d *Database) WatchEventsCtx(ctx context.Context, eventName string, callback func(context.Context, Event) error) error {
+	return d.WatchEventsWith(ctx, eventName, WatchOptions{}, callback)
+}
+
+// WatchEventsWith runs callback on every new eventName event until ctx is done, on one replica of the
+// consumer group at a time. A lost connection is retried with backoff, and a watcher whose resume token
+// expired catches up from the sequence of the last event it processed, so events are processed at least
+// once. A failing callback is retried with backoff and the watcher does not move past the event until it
+// succeeds, callbacks return nil to skip an event they can never process.
+func (d *Database) WatchEventsWith(ctx context.Context, eventName string, opts WatchOptions, callback func(context.Context, Event) error) error {
+	if opts.Group == "" {
+		opts.Group = eventName
+	}
+	return d.watchEvents(ctx, []string{eventName}, opts, callback)
+}
+
+// watchEvents follows the events of several names in the order of their sequences with one position,
+// opts.Group is required
+func (d *Database) watchEvents(ctx context.Context, eventNames []string, opts WatchOptions, callback func(context.Context, Event) error) error {
+	if opts.Parallelism < 1 {
+		opts.Parallelism = 1
+	}
+	w := &watcher{id: opts.Group, events: eventNames, runner: nues.ServiceId + "-" + GenerateId()[:8], opts: opts, callback: callback}
+	// the watchers of a group share their position, a second one in the process would process the events again
+	if _, loaded := watcherStates.LoadOrStore(w.id, watcherState{Standby: true}); loaded {
+		return fmt.Errorf("watcher group %s already runs in this service", w.id)
+	}
+	if _, err := w.position(ctx); err != nil {
+		watcherStates.Delete(w.id)
+		slog.Error("watcher failed for event", "watcher", w.id, "error", err)
+		return err
+	}
+	go w.run(ctx)
+	return nil
+}
+
+// run processes the events while this replica holds the lease of the watcher, until ctx is done
+func (w *watcher) run(ctx context.Context) {
+	ticker := time.NewTicker(watcherLeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		if acquired, err := acquireWatcherLease(ctx, w.id, w.runner); err != nil {
+			slog.Error("watcher lease failed", "watcher", w.id, "err", err)
+		} else if acquired {
+			err := w.lead(ctx)
+			if ctx.Err() != nil {
+				releaseWatcherLease(context.WithoutCancel(ctx), w.id, w.runner)
+				watcherStates.Delete(w.id)
+				slog.Info("watcher stopping...", "watcher", w.id)
+				return
+			}
+			if errors.Is(err, errWatcherPositionLost) {
+				// the state stays so readiness reports it
+				releaseWatcherLease(context.WithoutCancel(ctx), w.id, w.runner)
+				setWatcherState(w.id, func(s *watcherState) {
+					s.Running = false
+					s.Standby = false
+					s.Err = err.Error()
+				})
+				slog.Error("watcher stopped", "watcher", w.id, "err", err)
+				return
+			}
+			slog.Warn("watcher handed over", "watcher", w.id, "err", err)
+		} else {
+			setWatcherState(w.id, func(s *watcherState) {
+				s.Running = false
+				s.Standby = true
+			})
+		}
+		select {
+		case <-ctx.Done():
+			watcherStates.Delete(w.id)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lead follows the events, reconnecting with backoff, until the lease is lost or ctx is done
+func (w *watcher) lead(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		ticker := time.NewTicker(watcherLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			acquired, err := acquireWatcherLease(ctx, w.id, w.runner)
+			if err == nil && !acquired {
+				err = errWatcherLeaseLost
+			}
+			if err != nil {
+				cancel(err)
+				return
+			}
+		}
+	}()
+
+	attempts := 0
+	for {
+		err := w.follow(ctx, func() { attempts = 0 })
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if errors.Is(err, mongo.ErrClientDisconnected) || errors.Is(err, errWatcherLeaseLost) || errors.Is(err, errWatcherPositionLost) {
+			return err
+		}
+		metricWatcherRestarts.WithLabelValues(w.id).Inc()
+		setWatcherState(w.id, func(s *watcherState) {
+			s.Running = false
+			s.Err = err.Error()
+			s.Restarts++
+		})
+		if errors.Is(err, errResumeLost) {
+			slog.Warn("watcher resume token lost, catching up by sequence", "watcher", w.id)
+			continue
+		}
+		attempts++
+		delay := watcherBackoff(attempts)
+		slog.Error("watcher db error", "watcher", w.id, "err", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// position loads the watcher document, a new watcher starts after the last event registered
+func (w *watcher) position(ctx context.Context) (*watcherDoc, error) {
+	doc := &watcherDoc{}
+	err := DB.GetCollection(nues.colWatchers).FindOne(ctx, bson.M{"_id": w.id}).Decode(doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if err == nil && (doc.Sequence != nil || doc.Resume != nil) {
+		return doc, nil
+	}
+	last, err := getLastSeq(ctx, bson.D{{Key: "name", Value: w.names()}})
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{"sequence": last, "resume": nil}
+	if len(w.events) == 1 {
+		set["event"] = w.events[0]
+	} else {
+		set["events"] = w.events
+	}
+	_, err = DB.GetCollection(nues.colWatchers).UpdateOne(ctx, bson.M{"_id": w.id, "sequence": nil, "resume": nil},
+		bson.M{"$set": set}, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// another replica of the group created it first
+		return w.position(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &watcherDoc{Id: w.id, Sequence: &last}, nil
+}
+
+// names matches the names of the events followed
+func (w *watcher) names() any {
+	if len(w.events) == 1 {
+		return w.events[0]
+	}
+	return bson.M{"$in": w.events}
+}
+
+// follow opens the change stream and processes events until it fails. Without resume token the events
+// since the watcher sequence are caught up around the opening of the stream, so none is missed.
+func (w *watcher) follow(ctx context.Context, connected func()) error {
+	doc, err := w.position(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	d := w.dispatch(ctx, cancel)
+	defer d.stop()
+
+	var seq int64
+	if doc.Resume == nil {
+		// most of the backlog goes before the stream opens, so few events are read by both
+		if seq, err = w.catchUp(ctx, d, *doc.Sequence, nil); err != nil {
+			return err
+		}
+	}
+
+	pipe := bson.D{{Key: "$match", Value: bson.D{{Key: "operationType", Value: "insert"}, {Key: "fullDocument.name", Value: w.names()}}}}
+	opts := options.ChangeStream()
+	if doc.Resume != nil {
+		opts.SetResumeAfter(doc.Resume)
+	}
+	st, err := DB.Events().Watch(ctx, mongo.Pipeline{pipe}, opts)
+	if err != nil {
+		return w.streamError(ctx, err, doc)
+	}
+	defer st.Close(context.WithoutCancel(ctx))
+	connected()
+	setWatcherState(w.id, func(s *watcherState) {
+		s.Running = true
+		s.Standby = false
+		s.Err = ""
+	})
+
+	// the events registered while the stream opened are read by both, the stream skips them by id
+	seen := map[string]bool{}
+	if doc.Resume == nil {
+		if _, err = w.catchUp(ctx, d, seq, seen); err != nil {
+			return err
+		}
+	}
+
+	for st.Next(ctx) {
+		var change struct {
+			FullDocument Event `bson:"fullDocument"`
+		}
+		if err := st.Decode(&change); err != nil {
+			// the token still moves past what can't be read
+			slog.Error("watch decode failed", "watcher", w.id, "err", err)
+			d.submit(ctx, &watchItem{resume: st.ResumeToken(), skip: true})
+			continue
+		}
+		if seen[change.FullDocument.Id] {
+			delete(seen, change.FullDocument.Id)
+			continue
+		}
+		d.submit(ctx, &watchItem{ev: change.FullDocument, resume: st.ResumeToken()})
+	}
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+	return w.streamError(ctx, st.Err(), doc)
+}
+
+// catchUp submits the events after seq and records their id in seen when given, it returns
+// the last sequence submitted
+func (w *watcher) catchUp(ctx context.Context, d *watchDispatch, seq int64, seen map[string]bool) (int64, error) {
+	cur, err := DB.Events().Find(ctx, bson.M{"name": w.names(), "sequence": bson.M{"$gt": seq}},
+		options.Find().SetSort(bson.D{{Key: "sequence", Value: 1}}))
+	if err != nil {
+		return seq, err
+	}
+	defer cur.Close(context.WithoutCancel(ctx))
+	for cur.Next(ctx) {
+		var ev Event
+		if err := cur.Decode(&ev); err != nil {
+			slog.Error("watch decode failed", "watcher", w.id, "err", err)
+			continue
+		}
+		if seen != nil {
+			seen[ev.Id] = true
+		}
+		d.submit(ctx, &watchItem{ev: ev})
+		seq = ev.Sequence
+	}
+	return seq, cur.Err()
+}
+
+// process runs the callback on ev until it succeeds, it returns false when ctx is done first
+func (w *watcher) process(ctx context.Context, ev Event) bool {
+	slog.Debug("event", "op", ev.Name, "seq", ev.Sequence)
+	for attempts := 1; ; attempts++ {
+		// continue the trace of the request that registered the event
+		cbCtx, span := startSpan(extractTrace(ctx, ev.Trace), "watch "+w.id, trace.SpanKindConsumer,
+			attribute.Int64("nues.sequence", ev.Sequence), attribute.Int("nues.attempt", attempts))
+		err := w.callback(cbCtx, ev)
+		endSpan(span, err)
+		setWatcherState(w.id, func(s *watcherState) {
+			s.LastEvent = time.Now()
+		})
+		if err == nil {
+			return true
+		}
+		metricWatcherFailures.WithLabelValues(w.id).Inc()
+		delay := watcherBackoff(attempts)
+		slog.ErrorContext(cbCtx, "watcher callback failed", "ev", ev.Name, "seq", ev.Sequence, "err", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
+
+// save moves the watcher position while this replica holds its lease, a nil resume token is kept as it is
+func (w *watcher) save(ctx context.Context, seq *int64, resume bson.Raw) error {
+	set := bson.M{"changed": time.Now()}
+	if resume != nil {
+		set["resume"] = resume
+	}
+	if seq != nil {
+		set["sequence"] = *seq
+	}
+	res, err := DB.GetCollection(nues.colWatchers).UpdateOne(context.WithoutCancel(ctx),
+		bson.M{"_id": w.id, "runner": w.runner}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errWatcherLeaseLost
+	}
+	return nil
+}
+
+// streamError drops a resume token the server can't resume from anymore, the watcher then catches up
+// from its sequence. Watchers from before sequences were recorded only have their token, starting
+// from the last event would skip the ones since, so they stop until their sequence is set.
+func (w *watcher) streamError(ctx context.Context, err error, doc *watcherDoc) error {
+	if err == nil {
+		return errors.New("watcher change stream closed")
+	}
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return err
+	}
+	for _, code := range resumeLostCodes {
+		if !se.HasErrorCode(code) {
+			continue
+		}
+		if doc.Sequence == nil {
+			return fmt.Errorf("%w: set the sequence of watcher %s to the last event it processed", errWatcherPositionLost, w.id)
+		}
+		_, uerr := DB.GetCollection(nues.colWatchers).UpdateOne(ctx, bson.M{"_id": w.id, "runner": w.runner}, bson.M{"$set": bson.M{"resume": nil}})
+		if uerr != nil {
+			return uerr
+		}
+		return errResumeLost
+	}
+	return err
+}
+
+// watchItem is an event submitted to the workers of a watcher, skip ones only move the position
+type watchItem struct {
+	ev     Event
+	resume bson.Raw
+	skip   bool
+	done   bool
+}
+
+// watchDispatch spreads the events of a watcher on its workers by key, and moves the position of
+// the watcher past the events once every earlier one is processed too
+type watchDispatch struct {
+	w       *watcher
+	cancel  context.CancelCauseFunc
+	workers []chan *watchItem
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	pending []*watchItem
+	// position past the processed events at the head, not saved yet
+	seq    *int64
+	resume bson.Raw
+
+	// saveMu keeps the saves in order, each one writes the latest position
+	saveMu sync.Mutex
+}
+
+func (w *watcher) dispatch(ctx context.Context, cancel context.CancelCauseFunc) *watchDispatch {
+	d := &watchDispatch{w: w, cancel: cancel}
+	for i := 0; i < w.opts.Parallelism; i++ {
+		queue := make(chan *watchItem, watcherQueueSize)
+		d.workers = append(d.workers, queue)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for it := range queue {
+				// left pending, the events are processed again by the next follow
+				if ctx.Err() != nil || !w.process(ctx, it.ev) {
+					continue
+				}
+				d.complete(ctx, it)
+			}
+		}()
+	}
+	return d
+}
+
+func (d *watchDispatch) submit(ctx context.Context, it *watchItem) {
+	d.mu.Lock()
+	d.pending = append(d.pending, it)
+	d.mu.Unlock()
+	if it.skip {
+		d.complete(ctx, it)
+		return
+	}
+	key := it.ev.Id
+	if d.w.opts.Key != nil {
+		key = d.w.opts.Key(it.ev)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	select {
+	case d.workers[h.Sum32()%uint32(len(d.workers))] <- it:
+	case <-ctx.Done():
+	}
+}
+
+// complete marks it processed and saves the position past the processed events at the head
+func (d *watchDispatch) complete(ctx context.Context, it *watchItem) {
+	d.mu.Lock()
+	it.done = true
+	moved := false
+	for len(d.pending) > 0 && d.pending[0].done {
+		head := d.pending[0]
+		d.pending = d.pending[1:]
+		if !head.skip {
+			d.seq = &head.ev.Sequence
+			moved = true
+		}
+		if head.resume != nil {
+			d.resume = head.resume
+			moved = true
+		}
+	}
+	d.mu.Unlock()
+	if moved {
+		d.flush(ctx)
+	}
+}
+
+// flush saves the latest position, the ones completed while waiting are saved together
+func (d *watchDispatch) flush(ctx context.Context) {
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+	d.mu.Lock()
+	seq, resume := d.seq, d.resume
+	d.seq, d.resume = nil, nil
+	d.mu.Unlock()
+	if seq == nil && resume == nil {
+		return
+	}
+	if err := d.w.save(ctx, seq, resume); err != nil {
+		d.cancel(err)
+	}
+}
+
+// stop waits for the workers to finish the events they were given
+func (d *watchDispatch) stop() {
+	for _, queue := range d.workers {
+		close(queue)
+	}
+	d.wg.Wait()
+}
+
+// acquireWatcherLease takes or renews the right to process the events of the watcher
+func acquireWatcherLease(ctx context.Context, id, runner string) (bool, error) {
+	now := time.Now()
+	res, err := DB.GetCollection(nues.colWatchers).UpdateOne(ctx,
+		bson.M{"_id": id, "$or": bson.A{
+			bson.M{"runner": runner},
+			bson.M{"lease_until": bson.M{"$lt": now}},
+			bson.M{"lease_until": bson.M{"$exists": false}},
+		}},
+		bson.M{"$set": bson.M{"runner": runner, "lease_until": now.Add(watcherLeaseTTL)}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+func releaseWatcherLease(ctx context.Context, id, runner string) {
+	_, err := DB.GetCollection(nues.colWatchers).UpdateOne(ctx, bson.M{"_id": id, "runner": runner},
+		bson.M{"$unset": bson.M{"runner": "", "lease_until": ""}})
+	if err != nil {
+		slog.Error("watcher lease release failed", "watcher", id, "err", err)
+	}
+}
+
+// watcherBackoff is exponential in the attempts with jitter, capped to watcherBackoffMax
+func watcherBackoff(attempts int) time.Duration {
+	delay := watcherBackoffBase << (attempts - 1)
+	if delay > watcherBackoffMax || delay <= 0 {
+		delay = watcherBackoffMax
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
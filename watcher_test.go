@@ -0,0 +1,50 @@
+package nues
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWatcherProcessRetries(t *testing.T) {
+	t.Cleanup(func() { watcherStates.Delete("test_retry") })
+	calls := 0
+	w := &watcher{id: "test_retry", events: []string{"EvTestRetried"}, callback: func(ctx context.Context, ev Event) error {
+		calls++
+		if calls < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	}}
+	if !w.process(context.Background(), Event{Name: "EvTestRetried", Sequence: 1}) {
+		t.Fatal("event not processed")
+	}
+	if calls != 3 {
+		t.Fatalf("callback ran %d times, want 3", calls)
+	}
+
+	// a watcher stopping gives up, the event is left to the next holder
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w.callback = func(ctx context.Context, ev Event) error {
+		return errors.New("unavailable")
+	}
+	if w.process(ctx, Event{Name: "EvTestRetried", Sequence: 2}) {
+		t.Fatal("failing event processed")
+	}
+}
+
+func TestWatcherGroupOncePerService(t *testing.T) {
+	watcherStates.Store("test_group", watcherState{Running: true})
+	t.Cleanup(func() { watcherStates.Delete("test_group") })
+	err := DB.WatchEventsWith(context.Background(), "EvTestRetried", WatchOptions{Group: "test_group"}, func(ctx context.Context, ev Event) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("second watcher of a group started")
+	}
+	if s, _ := watcherStates.Load("test_group"); !s.(watcherState).Running {
+		t.Fatal("state of the running watcher replaced")
+	}
+}